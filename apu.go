@@ -1,5 +1,11 @@
 package famigo
 
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
 type apu struct {
 	FrameCounterInterruptInhibit   bool
 	FrameCounterSequencerMode      byte
@@ -7,17 +13,46 @@ type apu struct {
 	FrameCounterManualTrigger      bool
 	FrameCounter                   uint64
 
-	lastSample          float64
-	lastCorrectedSample float64
+	// left and right are kept separately all the way
+	// through, so panned channels end up in stereo
+	lastSample          [2]float64
+	lastCorrectedSample [2]float64
+
+	// the mix only needs recalculating when a channel changes
+	lastChannelLevels [numAPUChannels]byte
+	lastMix           [2]float64
+
+	// none of the output filtering is snapshotted, so after a load
+	// it's settled at the restored mix, rather than stepping up to
+	// it from silence (which pops)
+	resyncOutput bool
+
+	// expansion sound, from the cart. The chips' own state
+	// lives (and is snapshotted) in the mmc.
+	soundChips     []soundChip
+	chipLevels     []float64
+	lastChipLevels []float64
+
+	mixer mixer
 
+	blip   [2]blipBuf
 	buffer apuCircleBuf
+	output audioOutput
 
-	SampleP1    uint32
-	SampleP2    uint32
-	SampleTri   uint32
-	SampleDMC   uint32
-	SampleNoise uint32
-	NumSamples  uint32
+	// a fade out, for the nsf player. It's timed by samplesMixed,
+	// which counts every sample the emulation makes, including any
+	// dropped because the buffer was full. That keeps the fade in
+	// step with the song length, which is timed in emulated cycles.
+	samplesMixed uint64
+	fading       bool
+	fadeStart    uint64
+	fadeLen      uint64
+
+	// for the nsf player's silence detection
+	lastLoudSample uint64
+
+	// for the nsf player's oscilloscopes, nil otherwise
+	scope *nsfScope
 
 	Pulse1   sound
 	Pulse2   sound
@@ -33,7 +68,7 @@ const (
 	noiseSoundType    = 3
 )
 
-func (apu *apu) init() {
+func (apu *apu) init(timing *regionTiming, soundChips []soundChip) {
 	apu.Pulse1.SoundType = squareSoundType
 	apu.Pulse1.SweepUsesOnesComplement = true
 	apu.Pulse2.SoundType = squareSoundType
@@ -42,17 +77,52 @@ func (apu *apu) init() {
 	apu.Noise.SoundType = noiseSoundType
 	apu.Noise.NoiseShiftRegister = 1
 
-	apu.Noise.NoisePeriod = noisePeriodTable[0]
-	apu.DMC.DMCPeriod = dmcPeriodTable[0]
+	apu.Noise.NoisePeriod = timing.noisePeriods[0]
+	apu.DMC.DMCPeriod = timing.dmcPeriods[0]
+
+	names := apuChannelNames[:]
+	for _, chip := range soundChips {
+		names = append(names, chip.channelNames()...)
+	}
+	apu.mixer.init(names)
+	apu.attachSoundChips(soundChips)
+}
+
+// attachSoundChips hooks up the cart's expansion sound. It's separate
+// from init so a snapshot's mmc can be attached to the existing mixer.
+func (apu *apu) attachSoundChips(soundChips []soundChip) {
+	apu.soundChips = soundChips
+	numLevels := 0
+	for _, chip := range soundChips {
+		numLevels += len(chip.channelNames())
+	}
+	apu.chipLevels = make([]float64, numLevels)
+	apu.lastChipLevels = make([]float64, numLevels)
 }
 
+const apuCircleBufSize = 16 * 512 * 8 // must be power of 2
+
+// AudioFormat is the sample format ReadSoundBuffer produces
+type AudioFormat int
+
 const (
-	apuCircleBufSize = 16 * 512 * 4 // must be power of 2
-	samplesPerSecond = 44100
+	// AudioFormatInt16 is signed 16 bit little-endian samples
+	AudioFormatInt16 AudioFormat = iota
+	// AudioFormatFloat32 is little-endian float32 samples from -1 to 1
+	AudioFormatFloat32
 )
 
-const cyclesPerSecond = 1789773
-const cyclesPerSample = cyclesPerSecond / samplesPerSecond
+type audioOutput struct {
+	sampleRate int
+	channels   int
+	format     AudioFormat
+}
+
+var defaultAudioOutput = audioOutput{
+	sampleRate: 44100,
+	channels:   2,
+	format:     AudioFormatInt16,
+}
 
 // NOTE: size must be power of 2
 type apuCircleBuf struct {
@@ -88,36 +158,37 @@ func (c *apuCircleBuf) mask(i uint) uint { return i & (uint(len(c.buf)) - 1) }
 func (c *apuCircleBuf) size() uint       { return c.writeIndex - c.readIndex }
 func (c *apuCircleBuf) full() bool       { return c.size() == uint(len(c.buf)) }
 
-func (apu *apu) runFrameCounterCycle() {
+func (apu *apu) runFrameCounterCycle(timing *regionTiming) {
+	c := apu.FrameCounter
 	if apu.FrameCounterSequencerMode == 0 {
-		c := apu.FrameCounter
-		if c == 2*3728+1 || c == 2*7456+1 || c == 2*11185+1 || c == 2*14914+1 {
+		steps := &timing.frameCounterSteps4
+		if c == steps[0] || c == steps[1] || c == steps[2] || c == steps[3] {
 			apu.runEnvCycle()
 			apu.Triangle.runTriangleLengthCycle()
 		}
-		if c == 2*7456+1 || c == 2*14914+1 {
+		if c == steps[1] || c == steps[3] {
 			apu.runLengthCycle()
 			apu.runSweepCycle()
 		}
-		if c == 2*14914 || c == 2*14914+1 || c == 2*14915 {
+		if c == steps[3]-1 || c == steps[3] || c == steps[3]+1 {
 			if !apu.FrameCounterInterruptInhibit {
 				apu.FrameCounterInterruptRequested = true
 			}
 		}
-		if c == 2*14915 {
+		if c == steps[3]+1 {
 			apu.FrameCounter = 0
 		}
 	} else {
-		c := apu.FrameCounter
-		if c == 2*3728+1 || c == 2*7456+1 || c == 2*11185+1 || c == 2*18640+1 {
+		steps := &timing.frameCounterSteps5
+		if c == steps[0] || c == steps[1] || c == steps[2] || c == steps[3] {
 			apu.runEnvCycle()
 			apu.Triangle.runTriangleLengthCycle()
 		}
-		if c == 2*7456+1 || c == 2*18640+1 {
+		if c == steps[1] || c == steps[3] {
 			apu.runLengthCycle()
 			apu.runSweepCycle()
 		}
-		if c == 2*18641 {
+		if c == steps[3]+1 {
 			apu.FrameCounter = 0
 		}
 	}
@@ -174,55 +245,47 @@ func (sound *sound) updateDMCOutput(emu *emuState) {
 	}
 }
 
-func (apu *apu) genSample(emu *emuState) {
-	apu.runFrameCounterCycle()
+func (apu *apu) runCycle(emu *emuState) {
+	timing := emu.timing()
+	apu.runFrameCounterCycle(timing)
 	if apu.FrameCounterInterruptRequested {
 		emu.CPU.IRQ = true
 	}
 
 	apu.runFreqCycle(emu)
 
-	apu.SampleP1 += uint32(apu.Pulse1.getSample(emu))
-	apu.SampleP2 += uint32(apu.Pulse2.getSample(emu))
-	apu.SampleTri += uint32(apu.Triangle.getSample(emu))
-	apu.SampleDMC += uint32(apu.DMC.getSample(emu))
-	apu.SampleNoise += uint32(apu.Noise.getSample(emu))
-	apu.NumSamples++
-
-	if apu.NumSamples >= cyclesPerSample {
-
-		p1 := float64(apu.SampleP1) / float64(apu.NumSamples)
-		p2 := float64(apu.SampleP2) / float64(apu.NumSamples)
-		tri := float64(apu.SampleTri) / float64(apu.NumSamples)
-		dmc := float64(apu.SampleDMC) / float64(apu.NumSamples)
-		noise := float64(apu.SampleNoise) / float64(apu.NumSamples)
-
-		pSamples := 95.88 / (8128/(p1+p2) + 100)
-		tdnSamples := 159.79 / (1/(tri/8227+noise/12241+dmc/22638) + 100)
-		sample := pSamples + tdnSamples
-
-		// dc blocker to center waveform
-		correctedSample := sample - apu.lastSample + 0.995*apu.lastCorrectedSample
-		apu.lastCorrectedSample = correctedSample
-		apu.lastSample = sample
-		sample = correctedSample
-
-		left, right := sample, sample
-
-		sampleL, sampleR := int16(left*32767.0), int16(right*32767.0)
-		apu.buffer.write([]byte{
-			byte(sampleL & 0xff),
-			byte(sampleL >> 8),
-			byte(sampleR & 0xff),
-			byte(sampleR >> 8),
-		})
-
-		apu.SampleP1 = 0
-		apu.SampleP2 = 0
-		apu.SampleTri = 0
-		apu.SampleDMC = 0
-		apu.SampleNoise = 0
-		apu.NumSamples = 0
+	levels := [numAPUChannels]byte{
+		pulse1Channel:   apu.Pulse1.getSample(emu),
+		pulse2Channel:   apu.Pulse2.getSample(emu),
+		triangleChannel: apu.Triangle.getSample(emu),
+		noiseChannel:    apu.Noise.getSample(emu),
+		dmcChannel:      apu.DMC.getSample(emu),
+	}
+	chipsChanged := apu.runSoundChips()
+	if apu.scope != nil {
+		apu.scope.observe(&levels, apu.chipLevels)
+	}
+
+	if levels != apu.lastChannelLevels || chipsChanged || apu.mixer.changed || apu.resyncOutput {
+		apu.lastChannelLevels = levels
+		apu.mixer.changed = false
+		for side := range apu.blip {
+			mix := apu.mixChannels(levels, apu.mixer.gains[side])
+			if apu.resyncOutput {
+				apu.settleOutput(side, mix)
+			} else {
+				apu.blip[side].addDelta(mix - apu.lastMix[side])
+			}
+			apu.lastMix[side] = mix
+		}
+		apu.resyncOutput = false
+	}
+
+	samplesPerCycle := float64(apu.output.sampleRate) / float64(timing.cpuCyclesPerSecond)
+	left, ok := apu.blip[0].advance(samplesPerCycle)
+	right, _ := apu.blip[1].advance(samplesPerCycle)
+	if ok {
+		apu.writeSample(left, right)
 	}
 
 	if apu.DMC.DMCInterruptRequested {
@@ -230,21 +293,146 @@ func (apu *apu) genSample(emu *emuState) {
 	}
 }
 
-func (apu *apu) readSoundBuffer(emu *emuState, toFill []byte) []byte {
-	if int(apu.buffer.size()) < len(toFill) {
-		//fmt.Println("audSize:", apu.buffer.size(), "len(toFill)", len(toFill), "buf[0]", apu.buffer.buf[0])
+// runSoundChips runs the expansion chips for a cycle,
+// returning whether any of their outputs changed
+func (apu *apu) runSoundChips() bool {
+	levels := apu.chipLevels
+	for _, chip := range apu.soundChips {
+		chip.runCycle()
+		n := len(chip.channelNames())
+		chip.getOutputs(levels[:n])
+		levels = levels[n:]
 	}
-	for int(apu.buffer.size()) < len(toFill) {
-		// stretch sound to fill buffer to avoid click
-		apu.genSample(emu)
+	changed := false
+	for i, level := range apu.chipLevels {
+		if level != apu.lastChipLevels[i] {
+			apu.lastChipLevels[i] = level
+			changed = true
+		}
 	}
-	return apu.buffer.read(toFill)
+	return changed
 }
 
-func (apu *apu) runCycle(emu *emuState) {
-	if !apu.buffer.full() {
-		apu.genSample(emu)
+func (apu *apu) mixChannels(levels [numAPUChannels]byte, gains []float64) float64 {
+	p1 := float64(levels[pulse1Channel]) * gains[pulse1Channel]
+	p2 := float64(levels[pulse2Channel]) * gains[pulse2Channel]
+	tri := float64(levels[triangleChannel]) * gains[triangleChannel]
+	noise := float64(levels[noiseChannel]) * gains[noiseChannel]
+	dmc := float64(levels[dmcChannel]) * gains[dmcChannel]
+
+	pSamples := 95.88 / (8128/(p1+p2) + 100)
+	tdnSamples := 159.79 / (1/(tri/8227+noise/12241+dmc/22638) + 100)
+
+	// expansion chips are mixed linearly, the way carts do it
+	chipSamples := 0.0
+	for i, level := range apu.chipLevels {
+		chipSamples += level * gains[numAPUChannels+i]
+	}
+	return pSamples + tdnSamples + chipSamples
+}
+
+func (apu *apu) writeSample(left, right float64) {
+	left = apu.dcBlock(0, left)
+	right = apu.dcBlock(1, right)
+
+	if math.Abs(left) > nsfSilenceLevel || math.Abs(right) > nsfSilenceLevel {
+		apu.lastLoudSample = apu.samplesMixed
+	}
+	if apu.fading {
+		gain := apu.getFadeGain()
+		left, right = left*gain, right*gain
+	}
+	apu.samplesMixed++
+
+	var frame [8]byte
+	var n int
+	if apu.output.channels == 1 {
+		n = apu.output.encodeSample(frame[:], (left+right)/2)
+	} else {
+		n = apu.output.encodeSample(frame[:], left)
+		n += apu.output.encodeSample(frame[n:], right)
 	}
+	apu.buffer.write(frame[:n])
+}
+
+// startFade fades the output to silence over fadeLen, starting delay from now
+func (apu *apu) startFade(delay, fadeLen time.Duration) {
+	apu.fading = true
+	apu.fadeStart = apu.samplesMixed + apu.output.durationToSamples(delay)
+	apu.fadeLen = apu.output.durationToSamples(fadeLen)
+}
+
+func (apu *apu) clearFade() {
+	apu.fading = false
+}
+
+// getSilenceLen is how long the output's been silent, counting
+// from the last resetSilence if it's been silent since then
+func (apu *apu) getSilenceLen() time.Duration {
+	samples := apu.samplesMixed - apu.lastLoudSample
+	return time.Duration(float64(samples) / float64(apu.output.sampleRate) * float64(time.Second))
+}
+
+func (apu *apu) resetSilence() {
+	apu.lastLoudSample = apu.samplesMixed
+}
+
+func (apu *apu) getFadeGain() float64 {
+	if apu.samplesMixed < apu.fadeStart {
+		return 1
+	}
+	fadeT := apu.samplesMixed - apu.fadeStart
+	if fadeT >= apu.fadeLen {
+		return 0
+	}
+	return 1 - float64(fadeT)/float64(apu.fadeLen)
+}
+
+func (o *audioOutput) durationToSamples(d time.Duration) uint64 {
+	return uint64(d.Seconds() * float64(o.sampleRate))
+}
+
+// settleOutput sets one side's filters as if the mix had been
+// sitting at level, leaving the dc blocker's output where it was
+// so it eases back to center from whatever was last heard
+func (apu *apu) settleOutput(side int, level float64) {
+	apu.blip[side] = blipBuf{integrator: level}
+	apu.lastSample[side] = level
+}
+
+// dcBlock centers the waveform of one side
+func (apu *apu) dcBlock(side int, sample float64) float64 {
+	correctedSample := sample - apu.lastSample[side] + 0.995*apu.lastCorrectedSample[side]
+	apu.lastCorrectedSample[side] = correctedSample
+	apu.lastSample[side] = sample
+	return correctedSample
+}
+
+// frameSize is the byte size of one sample for every channel
+func (o *audioOutput) frameSize() int {
+	if o.format == AudioFormatFloat32 {
+		return 4 * o.channels
+	}
+	return 2 * o.channels
+}
+
+func (o *audioOutput) encodeSample(dest []byte, sample float64) int {
+	sample = math.Max(-1, math.Min(1, sample))
+	if o.format == AudioFormatFloat32 {
+		binary.LittleEndian.PutUint32(dest, math.Float32bits(float32(sample)))
+		return 4
+	}
+	s := int16(sample * 32767.0)
+	dest[0], dest[1] = byte(s), byte(s>>8)
+	return 2
+}
+
+func (apu *apu) readSoundBuffer(emu *emuState, toFill []byte) []byte {
+	for int(apu.buffer.size()) < len(toFill) {
+		// stretch sound to fill buffer to avoid click
+		apu.writeSample(apu.lastSample[0], apu.lastSample[1])
+	}
+	return apu.buffer.read(toFill)
 }
 
 func (apu *apu) runFreqCycle(emu *emuState) {
@@ -461,17 +649,43 @@ func (sound *sound) loadLengthCounter(regVal byte) {
 var dmcPeriodTable = []uint16{
 	428, 380, 340, 320, 286, 254, 226, 214, 190, 160, 142, 128, 106, 84, 72, 54,
 }
+var palDMCPeriodTable = []uint16{
+	398, 354, 316, 298, 276, 236, 210, 198, 176, 148, 132, 118, 98, 78, 66, 50,
+}
 
-func (sound *sound) loadDMCPeriod(regVal byte) {
-	sound.DMCPeriod = dmcPeriodTable[regVal]
+func (sound *sound) loadDMCPeriod(regVal byte, periods []uint16) {
+	sound.DMCPeriod = periods[regVal]
 }
 
 var noisePeriodTable = []uint16{
 	4, 8, 16, 32, 64, 96, 128, 160, 202, 254, 280, 508, 762, 1016, 2034, 4068,
 }
+var palNoisePeriodTable = []uint16{
+	4, 8, 14, 30, 60, 88, 118, 148, 188, 236, 354, 472, 708, 944, 1890, 3778,
+}
+
+func (sound *sound) loadNoisePeriod(regVal byte, periods []uint16) {
+	sound.NoisePeriod = periods[regVal]
+}
 
-func (sound *sound) loadNoisePeriod(regVal byte) {
-	sound.NoisePeriod = noisePeriodTable[regVal]
+// getNote is what a pulse or triangle is playing. It's
+// shared with the mmc5, so the apu-only sweep mute is left
+// to the caller. Noise and dmc have no pitch to give.
+func (sound *sound) getNote() channelNote {
+	if !sound.On || sound.LengthCounter == 0 {
+		return channelNote{}
+	}
+	switch sound.SoundType {
+	case squareSoundType:
+		if vol := sound.getCurrentVolume(); vol > 0 && sound.PeriodTimer >= 8 {
+			return channelNote{Period: 16 * float64(sound.PeriodTimer+1), Volume: float64(vol) / 15}
+		}
+	case triangleSoundType:
+		if sound.TriangleLinearCounter > 0 && sound.PeriodTimer >= 2 {
+			return channelNote{Period: 32 * float64(sound.PeriodTimer+1), Volume: 1}
+		}
+	}
+	return channelNote{}
 }
 
 func (sound *sound) getCurrentVolume() byte {
@@ -620,10 +834,10 @@ func (sound *sound) writeDMCCurrentValue(val byte) {
 	sound.DMCCurrentValue = 0x7f & val
 }
 
-func (sound *sound) writeDMCFlagsAndRate(val byte) {
+func (sound *sound) writeDMCFlagsAndRate(val byte, timing *regionTiming) {
 	sound.DMCIRQEnabled = val&0x80 == 0x80
 	sound.DMCLoopEnabled = val&0x40 == 0x40
-	sound.loadDMCPeriod(val & 0x0f)
+	sound.loadDMCPeriod(val&0x0f, timing.dmcPeriods)
 	sound.updateFreq()
 	if !sound.DMCIRQEnabled {
 		sound.DMCInterruptRequested = false
@@ -635,9 +849,9 @@ func (sound *sound) writeNoiseLength(val byte) {
 	sound.VolumeRestart = true
 }
 
-func (sound *sound) writeNoiseControlReg(val byte) {
+func (sound *sound) writeNoiseControlReg(val byte, timing *regionTiming) {
 	sound.NoiseShortLoopFlag = val&0x80 == 0x80
-	sound.loadNoisePeriod(val & 0x0f)
+	sound.loadNoisePeriod(val&0x0f, timing.noisePeriods)
 	sound.updateFreq()
 }
 
@@ -0,0 +1,74 @@
+package famigo
+
+import "math"
+
+// blipBuf turns amplitude steps at arbitrary times into band-limited
+// samples, a la blargg's blip_buffer. Each step is added as a windowed
+// sinc impulse, and the output is the running sum of those impulses.
+// Because only steps are recorded, the cost is per change in output,
+// not per cpu cycle.
+type blipBuf struct {
+	ring       [blipRingSize]float64
+	pos        uint    // ring index of the sample currently being built
+	frac       float64 // how far into that sample we are, 0 to 1
+	integrator float64
+}
+
+const (
+	blipTaps     = 16 // also the latency in samples
+	blipPhases   = 32 // sub-sample time resolution
+	blipRingSize = 64 // must be power of 2, and > blipTaps
+	blipCutoff   = 0.45
+)
+
+var blipKernel = makeBlipKernel()
+
+func makeBlipKernel() [blipPhases][blipTaps]float64 {
+	var kernel [blipPhases][blipTaps]float64
+	const halfWidth = blipTaps / 2
+	for phase := 0; phase < blipPhases; phase++ {
+		frac := float64(phase) / blipPhases
+		sum := 0.0
+		for i := 0; i < blipTaps; i++ {
+			x := float64(i) - halfWidth - frac
+			if x <= -halfWidth || x >= halfWidth {
+				continue
+			}
+			// blackman window over the kernel's width
+			w := 0.42 + 0.5*math.Cos(math.Pi*x/halfWidth) + 0.08*math.Cos(2*math.Pi*x/halfWidth)
+			sinc := 1.0
+			if x != 0 {
+				sinc = math.Sin(2*math.Pi*blipCutoff*x) / (2 * math.Pi * blipCutoff * x)
+			}
+			kernel[phase][i] = w * sinc
+			sum += kernel[phase][i]
+		}
+		// each step must end up exactly delta tall
+		for i := range kernel[phase] {
+			kernel[phase][i] /= sum
+		}
+	}
+	return kernel
+}
+
+// addDelta records a step of size delta at the current time
+func (b *blipBuf) addDelta(delta float64) {
+	k := &blipKernel[int(b.frac*blipPhases)]
+	for i := uint(0); i < blipTaps; i++ {
+		b.ring[(b.pos+i)&(blipRingSize-1)] += delta * k[i]
+	}
+}
+
+// advance moves time forward by dt samples, which must be less
+// than one. If that finishes a sample, it's returned with ok set.
+func (b *blipBuf) advance(dt float64) (sample float64, ok bool) {
+	b.frac += dt
+	if b.frac < 1 {
+		return 0, false
+	}
+	b.frac--
+	b.integrator += b.ring[b.pos]
+	b.ring[b.pos] = 0
+	b.pos = (b.pos + 1) & (blipRingSize - 1)
+	return b.integrator, true
+}
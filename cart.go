@@ -19,6 +19,8 @@ type CartInfo struct {
 	Flags11 byte
 	Flags12 byte
 	Flags13 byte
+	Flags14 byte
+	Flags15 byte
 
 	IsNES2 bool
 }
@@ -43,13 +45,21 @@ func ParseCartInfo(cartBytes []byte) (*CartInfo, error) {
 		Flags11:        cartBytes[11],
 		Flags12:        cartBytes[12],
 		Flags13:        cartBytes[13],
+		Flags14:        cartBytes[14],
+		Flags15:        cartBytes[15],
 	}
-	if cart.Flags7&0xc0 == 0x80 {
+	if cart.Flags7&0x0c == 0x08 {
 		cart.IsNES2 = true
 	} else {
 		cart.PrgRAMSizeCode = cartBytes[8]
 	}
 
+	for _, size := range []int{cart.GetROMSizePrg(), cart.GetROMSizeChr()} {
+		if size < 0 || size > len(cartBytes) {
+			return nil, fmt.Errorf("rom file is smaller than its header claims")
+		}
+	}
+
 	return &cart, nil
 }
 
@@ -97,13 +107,57 @@ func (cart *CartInfo) HasTrainer() bool {
 func (cart *CartInfo) GetMapperNumber() int {
 	low := cart.Flags6 >> 4
 	high := cart.Flags7 & 0xf0
+	if cart.IsNES2 {
+		return int(cart.Flags8&0x0f)<<8 | int(high|low)
+	}
+	if cart.hasJunkInHeader() {
+		// e.g. "DiskDude!" - flags7 is probably junk too
+		return int(low)
+	}
 	return int(high | low)
 }
 
+// old dumping tools liked to sign their work in the unused
+// bytes at the end of the header, which is also where nes2.0 lives
+func (cart *CartInfo) hasJunkInHeader() bool {
+	return cart.Flags12 != 0 || cart.Flags13 != 0 || cart.Flags14 != 0 || cart.Flags15 != 0
+}
+
+// GetSubmapperNumber returns the nes2.0 submapper, or 0 for iNES 1.0 carts
+func (cart *CartInfo) GetSubmapperNumber() int {
+	if cart.IsNES2 {
+		return int(cart.Flags8 >> 4)
+	}
+	return 0
+}
+
+// nes2.0 sizes are either a plain 12-bit count of units or,
+// if the high nibble is all ones, an exponent-multiplier pair.
+// Exponents too big to fit any real rom file come back as -1.
+func nes2ROMSize(lsb, msbNibble byte, unitSize int) int {
+	if msbNibble == 0x0f {
+		exponent := uint(lsb >> 2)
+		if exponent > 30 {
+			return -1
+		}
+		multiplier := int(lsb&0x03)*2 + 1
+		return (1 << exponent) * multiplier
+	}
+	return (int(msbNibble)<<8 | int(lsb)) * unitSize
+}
+
+// nes2.0 ram sizes are stored as shift counts
+func nes2RAMSize(shiftCount byte) int {
+	if shiftCount == 0 {
+		return 0
+	}
+	return 64 << shiftCount
+}
+
 // GetROMSizePrg needs docs
 func (cart *CartInfo) GetROMSizePrg() int {
 	if cart.IsNES2 {
-		panic("must be updated for nes2.0")
+		return nes2ROMSize(cart.PrgROMSizeCode, cart.Flags9&0x0f, 16*1024)
 	}
 	return int(cart.PrgROMSizeCode) * 16 * 1024
 }
@@ -111,23 +165,20 @@ func (cart *CartInfo) GetROMSizePrg() int {
 // GetROMSizeChr needs docs
 func (cart *CartInfo) GetROMSizeChr() int {
 	if cart.IsNES2 {
-		panic("must be updated for nes2.0")
+		return nes2ROMSize(cart.ChrROMSizeCode, cart.Flags9>>4, 8*1024)
 	}
 	return int(cart.ChrROMSizeCode) * 8 * 1024
 }
 
 // IsChrRAM needs docs
 func (cart *CartInfo) IsChrRAM() bool {
-	if cart.IsNES2 {
-		panic("must be updated for nes2.0")
-	}
-	return cart.ChrROMSizeCode == 0
+	return cart.GetROMSizeChr() == 0
 }
 
-// GetRAMSizeChr needs docs
+// GetRAMSizeChr returns the size of volatile CHR RAM
 func (cart *CartInfo) GetRAMSizeChr() int {
 	if cart.IsNES2 {
-		panic("must be updated for nes2.0")
+		return nes2RAMSize(cart.Flags11 & 0x0f)
 	}
 	if cart.IsChrRAM() {
 		return 8 * 1024
@@ -135,17 +186,129 @@ func (cart *CartInfo) GetRAMSizeChr() int {
 	return 0
 }
 
-// GetRAMSizePrg needs docs
+// GetNVRAMSizeChr returns the size of battery-backed CHR RAM
+func (cart *CartInfo) GetNVRAMSizeChr() int {
+	if cart.IsNES2 {
+		return nes2RAMSize(cart.Flags11 >> 4)
+	}
+	return 0
+}
+
+// GetRAMSizePrg returns the size of volatile PRG RAM
 func (cart *CartInfo) GetRAMSizePrg() int {
 	if cart.IsNES2 {
-		panic("must be updated for nes2.0")
+		return nes2RAMSize(cart.Flags10 & 0x0f)
+	}
+	if cart.HasBatteryBackedRAM() {
+		return 0
+	}
+	return cart.getINES1RAMSizePrg()
+}
+
+// GetNVRAMSizePrg returns the size of battery-backed PRG RAM
+func (cart *CartInfo) GetNVRAMSizePrg() int {
+	if cart.IsNES2 {
+		return nes2RAMSize(cart.Flags10 >> 4)
 	}
+	if cart.HasBatteryBackedRAM() {
+		return cart.getINES1RAMSizePrg()
+	}
+	return 0
+}
+
+func (cart *CartInfo) getINES1RAMSizePrg() int {
 	if int(cart.PrgRAMSizeCode) == 0 {
 		return 8 * 1024
 	}
 	return int(cart.PrgRAMSizeCode) * 8 * 1024
 }
 
+// ConsoleType is the kind of system a cart was made for
+type ConsoleType int
+
+const (
+	// ConsoleNES is a regular NES/Famicom/Dendy
+	ConsoleNES ConsoleType = iota
+	// ConsoleVsSystem is a Nintendo Vs. System arcade board
+	ConsoleVsSystem
+	// ConsolePlayChoice10 is a Nintendo PlayChoice-10 arcade board
+	ConsolePlayChoice10
+	// ConsoleExtended means see GetExtendedConsoleType
+	ConsoleExtended
+)
+
+// GetConsoleType returns the system the cart was made for
+func (cart *CartInfo) GetConsoleType() ConsoleType {
+	if cart.IsNES2 {
+		return ConsoleType(cart.Flags7 & 0x03)
+	}
+	if cart.Flags7&0x01 != 0 {
+		return ConsoleVsSystem
+	}
+	if cart.Flags7&0x02 != 0 {
+		return ConsolePlayChoice10
+	}
+	return ConsoleNES
+}
+
+// GetExtendedConsoleType returns the raw nes2.0 extended console
+// type, only meaningful if GetConsoleType returns ConsoleExtended
+func (cart *CartInfo) GetExtendedConsoleType() int {
+	if cart.IsNES2 && cart.GetConsoleType() == ConsoleExtended {
+		return int(cart.Flags13 & 0x0f)
+	}
+	return 0
+}
+
+// TimingMode is the CPU/PPU timing a cart expects
+type TimingMode int
+
+const (
+	// TimingNTSC is the RP2C02 (North America, Japan)
+	TimingNTSC TimingMode = iota
+	// TimingPAL is the RP2C07 (Europe, Australia)
+	TimingPAL
+	// TimingMultiRegion means the cart works with any timing
+	TimingMultiRegion
+	// TimingDendy is the UMC 6527P (Russia and other famiclone regions)
+	TimingDendy
+)
+
+// GetTimingMode returns the cart's expected timing. For iNES 1.0
+// carts this is always NTSC, as the old TV system flag was
+// too rarely set correctly to be trusted.
+func (cart *CartInfo) GetTimingMode() TimingMode {
+	if cart.IsNES2 {
+		return TimingMode(cart.Flags12 & 0x03)
+	}
+	return TimingNTSC
+}
+
+// ExpansionDevice is the nes2.0 default expansion device
+type ExpansionDevice int
+
+const (
+	// ExpansionUnspecified means no default given
+	ExpansionUnspecified ExpansionDevice = 0x00
+	// ExpansionStandardControllers means two standard controllers
+	ExpansionStandardControllers ExpansionDevice = 0x01
+	// ExpansionFourScore means the NES Four Score/Satellite
+	ExpansionFourScore ExpansionDevice = 0x02
+	// ExpansionFamicomFourPlayer means the Famicom four player adapter
+	ExpansionFamicomFourPlayer ExpansionDevice = 0x03
+	// ExpansionZapper means a Zapper on port 2
+	ExpansionZapper ExpansionDevice = 0x08
+)
+
+// GetDefaultExpansionDevice returns the input device the cart
+// expects, or ExpansionUnspecified for iNES 1.0 carts
+func (cart *CartInfo) GetDefaultExpansionDevice() ExpansionDevice {
+	if cart.IsNES2 {
+		return ExpansionDevice(cart.Flags15 & 0x3f)
+	}
+	return ExpansionUnspecified
+}
+
 // GetROMOffsetPrg needs docs
 func (cart *CartInfo) GetROMOffsetPrg() int {
 	offs := 16
@@ -16,11 +16,27 @@ type options struct {
 	fastMode bool
 }
 
+// used when -samplerate is left at 0, it's what most
+// sound devices mix at, so it usually avoids a resample
+const defaultSampleRate = 48000
+
 func main() {
 
 	defer profiling.Start().Stop()
 
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		renderMain(os.Args[2:])
+		return
+	}
+
 	fastMode := flag.Bool("fast", false, "starts in fast mode (no frame wait)")
+	zapper := flag.Bool("zapper", false, "plugs a zapper into port 2, aimed with the mouse")
+	regionName := flag.String("region", "auto", "console timing: auto, ntsc, pal, or dendy")
+	stereo := flag.Bool("stereo", false, "pans the sound channels apart instead of mono-in-both-ears")
+	sampleRate := flag.Int("samplerate", 0, "audio output rate, 0 picks one for the sound device")
+	fdsBIOSFilename := flag.String("fdsbios", "disksys.rom", "famicom disk system bios, needed for .fds files")
+	nsfAutoEnd := flag.Bool("autoend", false, "nsf tracks with no known length end once they go silent or loop")
+	nsfSilenceLen := flag.Duration("silence", 3*time.Second, "with -autoend, how long a track can be silent before it's over")
 	flag.Parse()
 
 	args := flag.Args()
@@ -35,25 +51,70 @@ func main() {
 	// TODO: config file instead
 	devMode := fileExists("devmode")
 
-	var emu famigo.Emulator
-
-	fileMagic := string(romBytes[:4])
-	if fileMagic == "NESM" || fileMagic == "NSFE" {
-		// nsf(e) file
-		emu = famigo.NewNsfPlayer(romBytes, devMode)
-	} else {
-		// rom file
-		cartInfo, err := famigo.ParseCartInfo(romBytes)
-		dieIf(err)
-
-		if devMode {
-			fmt.Println("PRG ROM SIZE:", cartInfo.GetROMSizePrg())
-			fmt.Println("PRG RAM SIZE:", cartInfo.GetRAMSizePrg(), "( Battery backed:", cartInfo.HasBatteryBackedRAM(), ")")
-			fmt.Println("CHR ROM SIZE:", cartInfo.GetROMSizeChr())
-			fmt.Println("MAPPER NUM:", cartInfo.GetMapperNumber())
-		}
+	region, ok := regionsByName[*regionName]
+	assert(ok, "unknown region: "+*regionName)
+
+	// the emulator is made once the audio device is open, so it can
+	// generate sound at whatever rate the device ended up running at
+	makeEmu := func(sampleRate int) famigo.Emulator {
+		var emu famigo.Emulator
+		fileMagic := string(romBytes[:4])
+		if fileMagic == "NESM" || fileMagic == "NSFE" {
+			// nsf(e) file
+			emu = famigo.NewNsfPlayerWithOptions(romBytes, famigo.Options{
+				DevMode:       devMode,
+				Region:        region,
+				SampleRate:    sampleRate,
+				WideStereo:    *stereo,
+				NsfAutoEnd:    *nsfAutoEnd,
+				NsfSilenceLen: *nsfSilenceLen,
+			})
+		} else if famigo.IsFdsImage(romBytes) {
+			// disk image
+			biosBytes, err := ioutil.ReadFile(*fdsBIOSFilename)
+			dieIf(err)
+			emu, err = famigo.NewEmulatorWithOptions(romBytes, famigo.Options{
+				DevMode:    devMode,
+				Region:     region,
+				SampleRate: sampleRate,
+				WideStereo: *stereo,
+				FdsBIOS:    biosBytes,
+			})
+			if err != nil {
+				emu = famigo.NewErrEmu(fmt.Sprintf("emulator error\n%s", err.Error()))
+			}
+		} else {
+			// rom file
+			cartInfo, err := famigo.ParseCartInfo(romBytes)
+			dieIf(err)
+
+			if devMode {
+				fmt.Println("PRG ROM SIZE:", cartInfo.GetROMSizePrg())
+				fmt.Println("PRG RAM SIZE:", cartInfo.GetRAMSizePrg(), "( Battery backed:", cartInfo.GetNVRAMSizePrg(), ")")
+				fmt.Println("CHR ROM SIZE:", cartInfo.GetROMSizeChr())
+				fmt.Println("CHR RAM SIZE:", cartInfo.GetRAMSizeChr(), "( Battery backed:", cartInfo.GetNVRAMSizeChr(), ")")
+				fmt.Println("MAPPER NUM:", cartInfo.GetMapperNumber(), "( Submapper:", cartInfo.GetSubmapperNumber(), ")")
+				fmt.Println("NES 2.0 HEADER:", cartInfo.IsNES2)
+				fmt.Println("CONSOLE TYPE:", cartInfo.GetConsoleType())
+				fmt.Println("TIMING MODE:", cartInfo.GetTimingMode())
+				fmt.Println("EXPANSION DEVICE:", cartInfo.GetDefaultExpansionDevice())
+			}
 
-		emu = famigo.NewEmulator(romBytes, devMode)
+			emuOptions := famigo.Options{
+				DevMode:    devMode,
+				Region:     region,
+				SampleRate: sampleRate,
+				WideStereo: *stereo,
+			}
+			if *zapper {
+				emuOptions.ExpansionDevice = famigo.ExpansionZapper
+			}
+			emu, err = famigo.NewEmulatorWithOptions(romBytes, emuOptions)
+			if err != nil {
+				emu = famigo.NewErrEmu(fmt.Sprintf("emulator error\n%s", err.Error()))
+			}
+		}
+		return emu
 	}
 
 	glimmer.InitDisplayLoop(glimmer.InitDisplayLoopOptions{
@@ -61,19 +122,45 @@ func main() {
 		WindowWidth: 256*2 + 40, WindowHeight: 240*2 + 40,
 		RenderWidth: 256, RenderHeight: 240,
 		InitCallback: func(sharedState *glimmer.WindowState) {
-			startEmu(cartFilename, sharedState, emu, options{
+			audio := openAudio(*sampleRate)
+			startEmu(cartFilename, sharedState, makeEmu(audio.SamplesPerSecond), audio, options{
 				fastMode: *fastMode,
 			})
 		},
+		UpdateCallback: updateMouse,
 	})
 }
 
+var regionsByName = map[string]famigo.Region{
+	"auto":  famigo.RegionAuto,
+	"ntsc":  famigo.RegionNTSC,
+	"pal":   famigo.RegionPAL,
+	"dendy": famigo.RegionDendy,
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return !os.IsNotExist(err)
 }
 
-func startEmu(filename string, window *glimmer.WindowState, emu famigo.Emulator, options options) {
+// openAudio opens the sound device, asking for sampleRate if it's set.
+// The emulator should be given the rate in the returned buffer, which
+// is what the device was actually opened with.
+func openAudio(sampleRate int) *glimmer.AudioBuffer {
+	if sampleRate <= 0 {
+		sampleRate = defaultSampleRate
+	}
+	audio, err := glimmer.OpenAudioBuffer(glimmer.OpenAudioBufferOptions{
+		OutputBufDuration: 25 * time.Millisecond,
+		SamplesPerSecond:  sampleRate,
+		BitsPerSample:     16,
+		ChannelCount:      2,
+	})
+	dieIf(err)
+	return audio
+}
+
+func startEmu(filename string, window *glimmer.WindowState, emu famigo.Emulator, audio *glimmer.AudioBuffer, options options) {
 
 	snapshotPrefix := filename + ".snapshot"
 
@@ -89,13 +176,6 @@ func startEmu(filename string, window *glimmer.WindowState, emu famigo.Emulator,
 		fmt.Println("error loading savefile,", err)
 	}
 
-	audio, audioErr := glimmer.OpenAudioBuffer(glimmer.OpenAudioBufferOptions{
-		OutputBufDuration: 25 * time.Millisecond,
-		SamplesPerSecond:  44100,
-		BitsPerSample:     16,
-		ChannelCount:      2,
-	})
-	dieIf(audioErr)
 	workingAudioBuffer := make([]byte, audio.GetPrevCallbackReadLen())
 	audioToGen := audio.GetPrevCallbackReadLen()
 
@@ -115,6 +195,17 @@ func startEmu(filename string, window *glimmer.WindowState, emu famigo.Emulator,
 				Left: window.CharIsDown('a'), Right: window.CharIsDown('d'),
 				A: window.CharIsDown('k'), B: window.CharIsDown('j'),
 			},
+			Joypad2: famigo.Joypad{
+				Sel: window.CharIsDown(';'), Start: window.CharIsDown('\''),
+				Up: window.CodeIsDown(glimmer.KeyCodeArrowUp), Down: window.CodeIsDown(glimmer.KeyCodeArrowDown),
+				Left: window.CodeIsDown(glimmer.KeyCodeArrowLeft), Right: window.CodeIsDown(glimmer.KeyCodeArrowRight),
+				A: window.CharIsDown('/'), B: window.CharIsDown('.'),
+			},
+			Zapper: famigo.Zapper{
+				X: mouse.x, Y: mouse.y, Trigger: mouse.leftDown,
+			},
+			DiskEject:    window.CharIsDown('e'),
+			DiskNextSide: window.CharIsDown('f'),
 		}
 		numDown := 'x'
 		for r := '0'; r <= '9'; r++ {
@@ -157,6 +248,10 @@ func startEmu(filename string, window *glimmer.WindowState, emu famigo.Emulator,
 		emu.UpdateInput(newInput)
 		emu.Step()
 
+		if err := emu.Err(); err != nil {
+			emu = famigo.NewErrEmu(fmt.Sprintf("emulation stopped\n%s", err.Error()))
+		}
+
 		if emu.GetSoundBufferUsed() >= audioToGen {
 			if cap(workingAudioBuffer) < audioToGen {
 				workingAudioBuffer = make([]byte, audioToGen)
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/theinternetftw/glimmer"
+)
+
+// glimmer's WindowState only has the keyboard, so the mouse is
+// read straight from ebiten here, and nowhere else. That leans on
+// two things glimmer does, which should be checked whenever it's
+// bumped (ebiten's pinned in go.mod to the version glimmer uses):
+//
+// UpdateCallback is called from ebiten's Game.Update, the one
+// place ebiten's input state is meant to be read from.
+//
+// glimmer's Layout returns the render size, so ebiten gives the
+// cursor in framebuffer pixels (0-255, 0-239), not window pixels.
+//
+// Once glimmer has cursor and button state of its own, this
+// should go, and the zapper should read it from the WindowState.
+
+// mouse must only be touched with the window's InputMutex held
+var mouse struct {
+	x, y     int
+	leftDown bool
+}
+
+// updateMouse is the display loop's UpdateCallback
+func updateMouse(window *glimmer.WindowState) {
+	x, y := ebiten.CursorPosition()
+	leftDown := ebiten.IsMouseButtonPressed(ebiten.MouseButtonLeft)
+
+	window.InputMutex.Lock()
+	mouse.x, mouse.y, mouse.leftDown = x, y, leftDown
+	window.InputMutex.Unlock()
+}
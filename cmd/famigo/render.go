@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/theinternetftw/famigo"
+)
+
+// renderMain is "famigo render", which writes nsf tracks
+// out to wav files without opening a window
+func renderMain(args []string) {
+
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	track := flags.Int("track", 0, "track to render, starting at 1 (default all tracks)")
+	length := flags.Duration("length", 3*time.Minute, "track length before the fade, when the file doesn't say")
+	fadeLength := flags.Duration("fade", 5*time.Second, "fade out length, when the file doesn't say")
+	forceLengths := flags.Bool("force-lengths", false, "use -length and -fade even when the file has its own")
+	outDir := flags.String("out", ".", "directory to write the wav files to")
+	regionName := flags.String("region", "auto", "console timing: auto, ntsc, pal, or dendy")
+	sampleRate := flags.Int("samplerate", 48000, "audio output rate")
+	stereo := flags.Bool("stereo", false, "pans the sound channels apart instead of mono-in-both-ears")
+	sfx := flags.Bool("sfx", false, "also render the tracks an nsfe marks as sound effects, when rendering all tracks")
+	flags.Parse(args)
+
+	assert(flags.NArg() == 1, "usage: ./famigo render [FLAGS] NSF_FILENAME")
+	nsfFilename := flags.Arg(0)
+
+	nsfBytes, err := ioutil.ReadFile(nsfFilename)
+	dieIf(err)
+
+	info, err := famigo.ParseNsfInfo(nsfBytes)
+	dieIf(err)
+
+	region, ok := regionsByName[*regionName]
+	assert(ok, "unknown region: "+*regionName)
+
+	opts := famigo.Options{
+		Region:     region,
+		SampleRate: *sampleRate,
+		WideStereo: *stereo,
+	}
+
+	first, last := 0, len(info.Tracks)-1
+	if *track != 0 {
+		assert(*track >= 1 && *track <= len(info.Tracks), fmt.Sprintf("no track %v, the file has %v", *track, len(info.Tracks)))
+		first, last = *track-1, *track-1
+	}
+
+	baseName := strings.TrimSuffix(filepath.Base(nsfFilename), filepath.Ext(nsfFilename))
+	for i := first; i <= last; i++ {
+		if *track == 0 && info.Tracks[i].IsSoundEffect && !*sfx {
+			continue
+		}
+		trackLen, trackFadeLen := *length, *fadeLength
+		if t := info.Tracks[i]; t.Length > 0 && !*forceLengths {
+			trackLen, trackFadeLen = t.Length, t.FadeLength
+		}
+
+		wavFilename := filepath.Join(*outDir, fmt.Sprintf("%s-%02d.wav", baseName, i+1))
+		fmt.Printf("rendering track %02d (%v + %v fade) to %s\n", i+1, trackLen, trackFadeLen, wavFilename)
+
+		pcm := bytes.Buffer{}
+		err := famigo.RenderNsfTrack(&pcm, nsfBytes, i, trackLen, trackFadeLen, opts)
+		dieIf(err)
+		dieIf(writeWav(wavFilename, pcm.Bytes(), *sampleRate, 2))
+	}
+}
+
+// writeWav writes 16-bit pcm out as a wav file
+func writeWav(filename string, pcm []byte, sampleRate, channels int) error {
+	const bytesPerSample = 2
+	hdr := struct {
+		RiffID        [4]byte
+		RiffSize      uint32
+		WaveID        [4]byte
+		FmtID         [4]byte
+		FmtSize       uint32
+		AudioFormat   uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+		DataID        [4]byte
+		DataSize      uint32
+	}{
+		RiffID:        [4]byte{'R', 'I', 'F', 'F'},
+		RiffSize:      uint32(36 + len(pcm)),
+		WaveID:        [4]byte{'W', 'A', 'V', 'E'},
+		FmtID:         [4]byte{'f', 'm', 't', ' '},
+		FmtSize:       16,
+		AudioFormat:   1, // pcm
+		Channels:      uint16(channels),
+		SampleRate:    uint32(sampleRate),
+		ByteRate:      uint32(sampleRate * channels * bytesPerSample),
+		BlockAlign:    uint16(channels * bytesPerSample),
+		BitsPerSample: 8 * bytesPerSample,
+		DataID:        [4]byte{'d', 'a', 't', 'a'},
+		DataSize:      uint32(len(pcm)),
+	}
+
+	out := bytes.Buffer{}
+	if err := binary.Write(&out, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	out.Write(pcm)
+	return ioutil.WriteFile(filename, out.Bytes(), 0644)
+}
@@ -1,14 +1,24 @@
 package famigo
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // Emulator exposes the public facing fns for an emulation session
 type Emulator interface {
 	Step()
 
+	// Err returns the error that stopped emulation, if any.
+	// Once set, Step does nothing.
+	Err() error
+
 	MakeSnapshot() []byte
 	LoadSnapshot([]byte) (Emulator, error)
 
+	// SetPrgRAM and GetPrgRAM are for battery backed saves. For
+	// disk images they're the disk itself (as a headerless .fds),
+	// and GetPrgRAM returns nil until the game has written to it.
 	SetPrgRAM([]byte) error
 	GetPrgRAM() []byte
 
@@ -19,18 +29,98 @@ type Emulator interface {
 	ReadSoundBuffer([]byte) []byte
 	GetSoundBufferUsed() int
 
+	// GetChannelMix returns the mix settings of every sound channel
+	GetChannelMix() []ChannelMix
+	// SetChannelMix changes the mix settings of channel i
+	SetChannelMix(i int, m ChannelMix) error
+
 	InDevMode() bool
 	SetDevMode(b bool)
 }
 
 // Input covers all outside info sent to the Emulator
 type Input struct {
-	Joypad Joypad
+	Joypad  Joypad // port 1
+	Joypad2 Joypad // port 2
+	Joypad3 Joypad // four player adapters only
+	Joypad4 Joypad // four player adapters only
+	Zapper  Zapper // port 2, when a zapper is plugged in
+
+	// disk system only
+	DiskEject    bool // each press ejects or reinserts the disk
+	DiskNextSide bool // each press swaps to the disk's next side
+}
+
+// Options covers the less common settings for NewEmulatorWithOptions
+type Options struct {
+	DevMode bool
+
+	// ExpansionDevice picks what's plugged into the input ports.
+	// ExpansionUnspecified means use what the cart header asks
+	// for, falling back to two standard controllers.
+	ExpansionDevice ExpansionDevice
+
+	// Region picks the console timing. RegionAuto means use
+	// what the cart header asks for, falling back to NTSC.
+	Region Region
+
+	// Audio output settings for ReadSoundBuffer. Zero values
+	// mean 44100hz, stereo, and AudioFormatInt16 respectively.
+	SampleRate    int
+	AudioChannels int
+	AudioFormat   AudioFormat
+
+	// WideStereo starts with the sound channels panned apart,
+	// rather than all in the center. Pans can be changed later
+	// with SetChannelMix either way.
+	WideStereo bool
+
+	// FdsBIOS is the Famicom Disk System's 8k bios rom,
+	// needed to run disk images (see IsFdsImage).
+	FdsBIOS []byte
+
+	// NsfAutoEnd has the nsf player guess where tracks of unknown
+	// length end: once they've been silent for NsfSilenceLen, or
+	// once they've looped twice, after which they fade out. Zero
+	// NsfSilenceLen means 3 seconds.
+	NsfAutoEnd    bool
+	NsfSilenceLen time.Duration
+}
+
+func (opts *Options) getAudioOutput() (audioOutput, error) {
+	output := defaultAudioOutput
+	if opts.SampleRate != 0 {
+		output.sampleRate = opts.SampleRate
+	}
+	if opts.AudioChannels != 0 {
+		output.channels = opts.AudioChannels
+	}
+	output.format = opts.AudioFormat
+
+	if output.sampleRate < 8000 || output.sampleRate > 192000 {
+		return audioOutput{}, fmt.Errorf("unsupported sample rate: %v", output.sampleRate)
+	}
+	if output.channels != 1 && output.channels != 2 {
+		return audioOutput{}, fmt.Errorf("unsupported audio channel count: %v", output.channels)
+	}
+	if output.format != AudioFormatInt16 && output.format != AudioFormatFloat32 {
+		return audioOutput{}, fmt.Errorf("unknown audio format: %v", output.format)
+	}
+	return output, nil
 }
 
 // NewEmulator creates an emulation session
-func NewEmulator(cart []byte, devMode bool) Emulator {
-	return newState(cart, devMode)
+func NewEmulator(cart []byte, devMode bool) (Emulator, error) {
+	return NewEmulatorWithOptions(cart, Options{DevMode: devMode})
+}
+
+// NewEmulatorWithOptions creates an emulation session with the given options
+func NewEmulatorWithOptions(cart []byte, opts Options) (Emulator, error) {
+	emu, err := newState(cart, opts)
+	if err != nil {
+		return nil, err
+	}
+	return emu, nil
 }
 
 func (emu *emuState) MakeSnapshot() []byte {
@@ -41,7 +131,8 @@ func (emu *emuState) LoadSnapshot(snapBytes []byte) (Emulator, error) {
 	return emu.loadSnapshot(snapBytes)
 }
 
-// GetSoundBuffer returns a 44100hz * 16bit * 2ch sound buffer.
+// ReadSoundBuffer returns sound in the format chosen by Options,
+// which is 44100hz * 16bit * 2ch unless set otherwise.
 // A pre-sized buffer must be provided, which is returned resized
 // if the buffer was less full than the length requested.
 func (emu *emuState) ReadSoundBuffer(toFill []byte) []byte {
@@ -52,17 +143,33 @@ func (emu *emuState) GetSoundBufferUsed() int {
 	return int(emu.APU.buffer.size())
 }
 
+func (emu *emuState) GetChannelMix() []ChannelMix {
+	return emu.APU.mixer.getChannelMix()
+}
+
+func (emu *emuState) SetChannelMix(i int, m ChannelMix) error {
+	return emu.APU.mixer.setChannelMix(i, m)
+}
+
 func (emu *emuState) UpdateInput(input Input) {
+	emu.CurrentJoypad1 = input.Joypad.withoutImpossibleInputs()
+	emu.CurrentJoypad2 = input.Joypad2.withoutImpossibleInputs()
+	emu.CurrentJoypad3 = input.Joypad3.withoutImpossibleInputs()
+	emu.CurrentJoypad4 = input.Joypad4.withoutImpossibleInputs()
+	emu.CurrentZapper = input.Zapper
+	emu.CurrentDiskEject = input.DiskEject
+	emu.CurrentDiskNextSide = input.DiskNextSide
+}
 
-	// prevent impossible inputs on original dpad
-	if input.Joypad.Up {
-		input.Joypad.Down = false
+// prevent impossible inputs on original dpad
+func (jp Joypad) withoutImpossibleInputs() Joypad {
+	if jp.Up {
+		jp.Down = false
 	}
-	if input.Joypad.Left {
-		input.Joypad.Right = false
+	if jp.Left {
+		jp.Right = false
 	}
-
-	emu.CurrentJoypad1 = input.Joypad
+	return jp
 }
 
 // Framebuffer returns the current state of the screen
@@ -79,6 +186,12 @@ func (emu *emuState) FlipRequested() bool {
 }
 
 func (emu *emuState) GetPrgRAM() []byte {
+	if disk, ok := emu.Mem.mmc.(*mapper020); ok {
+		if disk.DiskWritten {
+			return disk.getDiskImage()
+		}
+		return nil
+	}
 	if emu.CartInfo.HasBatteryBackedRAM() {
 		return emu.Mem.PrgRAM
 	}
@@ -86,6 +199,9 @@ func (emu *emuState) GetPrgRAM() []byte {
 }
 
 func (emu *emuState) SetPrgRAM(ram []byte) error {
+	if disk, ok := emu.Mem.mmc.(*mapper020); ok {
+		return disk.setDiskImage(ram)
+	}
 	if len(emu.Mem.PrgRAM) == len(ram) {
 		copy(emu.Mem.PrgRAM, ram)
 		return nil
@@ -95,5 +211,13 @@ func (emu *emuState) SetPrgRAM(ram []byte) error {
 }
 
 func (emu *emuState) Step() {
+	if emu.err != nil {
+		return
+	}
+	defer recoverEmuErr(&emu.err)
 	emu.step()
 }
+
+func (emu *emuState) Err() error {
+	return emu.err
+}
@@ -35,8 +35,13 @@ func (e *errEmu) LoadSnapshot([]byte) (Emulator, error) {
 }
 func (e *errEmu) ReadSoundBuffer(toFill []byte) []byte { return nil }
 func (e *errEmu) GetSoundBufferUsed() int              { return 0 }
-func (e *errEmu) UpdateInput(input Input)              {}
-func (e *errEmu) Step()                                {}
+func (e *errEmu) GetChannelMix() []ChannelMix          { return nil }
+func (e *errEmu) SetChannelMix(i int, m ChannelMix) error {
+	return fmt.Errorf("no sound channels in errEmu")
+}
+func (e *errEmu) UpdateInput(input Input) {}
+func (e *errEmu) Step()                   {}
+func (e *errEmu) Err() error              { return nil }
 
 func (e *errEmu) Framebuffer() []byte { return e.screen[:] }
 func (e *errEmu) FlipRequested() bool {
@@ -2,7 +2,6 @@ package famigo
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/theinternetftw/cpugo/virt6502"
 )
@@ -24,16 +23,36 @@ type emuState struct {
 	Cycles   uint64
 	CartInfo *CartInfo
 
+	Region Region
+
+	// leftover ppu dots owed, for regions where
+	// it's not a whole number per cpu cycle
+	PPUDotFraction int
+
+	InputDevice ExpansionDevice
+
 	CurrentJoypad1 Joypad
-	CurrentJoypad2 Joypad // empty for now
+	CurrentJoypad2 Joypad
+	CurrentJoypad3 Joypad
+	CurrentJoypad4 Joypad
+	CurrentZapper  Zapper
 
+	CurrentDiskEject    bool
+	CurrentDiskNextSide bool
+
+	// latched from CurrentJoypadN when the strobe is
+	// released, then shifted out by read count
 	JoypadReg1          Joypad
 	JoypadReg2          Joypad
+	JoypadReg3          Joypad
+	JoypadReg4          Joypad
 	ReloadingJoypads    bool
 	JoypadReg1ReadCount byte
 	JoypadReg2ReadCount byte
 
 	devMode bool
+
+	err error // sticky, set when emulation hits a fatal error
 }
 
 func (emu *emuState) InDevMode() bool   { return emu.devMode }
@@ -46,41 +65,99 @@ func (emu *emuState) writeJoypadReg1(val byte) {
 		emu.JoypadReg2ReadCount = 0
 	} else if emu.ReloadingJoypads {
 		emu.ReloadingJoypads = false
+		emu.JoypadReg1 = emu.CurrentJoypad1
+		emu.JoypadReg2 = emu.CurrentJoypad2
+		emu.JoypadReg3 = emu.CurrentJoypad3
+		emu.JoypadReg4 = emu.CurrentJoypad4
 	}
 }
 func (emu *emuState) getCurrentButtonState(jp *Joypad, readCount byte) bool {
+	if readCount > 7 {
+		return true // official controllers return 1s when empty
+	}
 	tbl := []bool{jp.A, jp.B, jp.Sel, jp.Start, jp.Up, jp.Down, jp.Left, jp.Right}
 	return tbl[readCount]
 }
-func (emu *emuState) readJoypadReg1() byte {
-	jp := &emu.CurrentJoypad1
-	if emu.ReloadingJoypads {
-		return 0x40 | boolBit(jp.A, 0)
-	} else if emu.JoypadReg1ReadCount > 7 {
-		return 0x41
+
+// readJoypadPort handles both ports. The "extra" pad is the
+// player 3 or 4 pad that shares the port on four player setups.
+func (emu *emuState) readJoypadPort(readCount *byte, current, latched, currentExtra, latchedExtra *Joypad, fourScoreSignature byte) byte {
+	switch emu.InputDevice {
+	case ExpansionFourScore:
+		if emu.ReloadingJoypads {
+			return 0x40 | boolBit(current.A, 0)
+		}
+		n := *readCount
+		var state bool
+		switch {
+		case n < 8:
+			state = emu.getCurrentButtonState(latched, n)
+		case n < 16:
+			state = emu.getCurrentButtonState(latchedExtra, n-8)
+		case n < 24:
+			state = (fourScoreSignature>>(n-16))&0x01 == 0x01
+		default:
+			state = true
+		}
+		if n < 24 {
+			*readCount++
+		}
+		return 0x40 | boolBit(state, 0)
+
+	case ExpansionFamicomFourPlayer:
+		// players 3 and 4 are on the expansion port, in bit 1
+		if emu.ReloadingJoypads {
+			return 0x40 | boolBit(currentExtra.A, 1) | boolBit(current.A, 0)
+		}
+		n := *readCount
+		state := emu.getCurrentButtonState(latched, n)
+		extraState := emu.getCurrentButtonState(latchedExtra, n)
+		if n < 8 {
+			*readCount++
+		}
+		return 0x40 | boolBit(extraState, 1) | boolBit(state, 0)
+
+	default:
+		if emu.ReloadingJoypads {
+			// while strobing, the shift reg keeps reloading
+			return 0x40 | boolBit(current.A, 0)
+		}
+		n := *readCount
+		state := emu.getCurrentButtonState(latched, n)
+		if n < 8 {
+			*readCount++
+		}
+		return 0x40 | boolBit(state, 0)
 	}
-	state := emu.getCurrentButtonState(jp, emu.JoypadReg1ReadCount)
-	emu.JoypadReg1ReadCount++
-	return 0x40 | boolBit(state, 0)
+}
+func (emu *emuState) readJoypadReg1() byte {
+	return emu.readJoypadPort(&emu.JoypadReg1ReadCount,
+		&emu.CurrentJoypad1, &emu.JoypadReg1,
+		&emu.CurrentJoypad3, &emu.JoypadReg3,
+		0x10,
+	)
 }
 
 // writes for this reg handled by apu.writeFrameCounterReg
 func (emu *emuState) readJoypadReg2() byte {
-	jp := &emu.CurrentJoypad2
-	if emu.ReloadingJoypads {
-		return 0x40 | boolBit(jp.A, 0)
-	} else if emu.JoypadReg2ReadCount > 7 {
-		return 0x41
+	if emu.InputDevice == ExpansionZapper {
+		return emu.readZapper()
 	}
-	state := emu.getCurrentButtonState(jp, emu.JoypadReg2ReadCount)
-	emu.JoypadReg2ReadCount++
-	return 0x40 | boolBit(state, 0)
+	return emu.readJoypadPort(&emu.JoypadReg2ReadCount,
+		&emu.CurrentJoypad2, &emu.JoypadReg2,
+		&emu.CurrentJoypad4, &emu.JoypadReg4,
+		0x20,
+	)
 }
 
 func (emu *emuState) runCycles(cycles uint) {
+	timing := emu.timing()
 	for i := uint(0); i < cycles; i++ {
-		for j := 0; j < 3; j++ {
-			emu.PPU.runCycle(emu) // ppu clock is 3x cpu
+		// ppu clock is 3x cpu on ntsc, 3.2x on pal
+		emu.PPUDotFraction += timing.ppuDotsPerCPUCycleNum
+		for emu.PPUDotFraction >= timing.ppuDotsPerCPUCycleDen {
+			emu.PPUDotFraction -= timing.ppuDotsPerCPUCycleDen
+			emu.PPU.runCycle(emu)
 		}
 		emu.APU.runCycle(emu)
 		emu.Mem.mmc.RunCycle(emu)
@@ -98,21 +175,51 @@ func (emu *emuState) step() {
 	emu.CPU.Step()
 }
 
-func newState(romBytes []byte, devMode bool) *emuState {
-	cartInfo, _ := ParseCartInfo(romBytes)
+func loadCart(romBytes []byte) (cartInfo *CartInfo, prgROM, chrROM []byte, mmc mmc, err error) {
+	if cartInfo, err = ParseCartInfo(romBytes); err != nil {
+		return nil, nil, nil, nil, err
+	}
 	prgStart := cartInfo.GetROMOffsetPrg()
 	prgEnd := prgStart + cartInfo.GetROMSizePrg()
 	chrStart := cartInfo.GetROMOffsetChr()
 	chrEnd := chrStart + cartInfo.GetROMSizeChr()
+	if prgStart > prgEnd || chrStart > chrEnd || prgEnd > len(romBytes) || chrEnd > len(romBytes) {
+		return nil, nil, nil, nil, fmt.Errorf("rom file is smaller than its header claims")
+	}
+	if mmc, err = makeMMC(cartInfo); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return cartInfo, romBytes[prgStart:prgEnd], romBytes[chrStart:chrEnd], mmc, nil
+}
+
+func newState(romBytes []byte, opts Options) (*emuState, error) {
+	var cartInfo *CartInfo
+	var prgROM, chrROM []byte
+	var mmc mmc
+	var err error
+	if IsFdsImage(romBytes) {
+		cartInfo, prgROM, mmc, err = loadFdsImage(romBytes, opts.FdsBIOS)
+	} else {
+		cartInfo, prgROM, chrROM, mmc, err = loadCart(romBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	audioOutput, err := opts.getAudioOutput()
+	if err != nil {
+		return nil, err
+	}
 	emu := emuState{
 		Mem: mem{
-			mmc:    makeMMC(cartInfo),
-			prgROM: romBytes[prgStart:prgEnd],
-			chrROM: romBytes[chrStart:chrEnd],
-			PrgRAM: make([]byte, cartInfo.GetRAMSizePrg()),
+			mmc:    mmc,
+			prgROM: prgROM,
+			chrROM: chrROM,
+			PrgRAM: make([]byte, getPrgRAMAllocSize(cartInfo)),
 		},
-		CartInfo: cartInfo,
-		devMode:  devMode,
+		CartInfo:    cartInfo,
+		Region:      getRegion(cartInfo, opts),
+		InputDevice: getInputDevice(cartInfo, opts),
+		devMode:     opts.DevMode,
 	}
 	emu.CPU = virt6502.Virt6502{
 		RESET:             true,
@@ -123,17 +230,59 @@ func newState(romBytes []byte, devMode bool) *emuState {
 		Err:               func(e error) { emuErr(e) },
 	}
 	if cartInfo.IsChrRAM() {
-		emu.Mem.chrROM = make([]byte, cartInfo.GetRAMSizeChr())
+		emu.Mem.chrROM = make([]byte, getChrRAMAllocSize(cartInfo))
+	}
+	emu.APU.output = audioOutput
+
+	if err := emu.init(); err != nil {
+		return nil, err
+	}
+	if opts.WideStereo {
+		emu.APU.mixer.applyWideStereo()
 	}
 
-	emu.init()
+	return &emu, nil
+}
+
+func getRegion(cartInfo *CartInfo, opts Options) Region {
+	if opts.Region != RegionAuto {
+		return opts.Region
+	}
+	return getRegionFromTimingMode(cartInfo.GetTimingMode())
+}
+
+func getInputDevice(cartInfo *CartInfo, opts Options) ExpansionDevice {
+	device := opts.ExpansionDevice
+	if device == ExpansionUnspecified {
+		device = cartInfo.GetDefaultExpansionDevice()
+	}
+	switch device {
+	case ExpansionFourScore, ExpansionFamicomFourPlayer, ExpansionZapper:
+		return device
+	}
+	return ExpansionStandardControllers
+}
 
-	return &emu
+// mappers expect some RAM to be there, even if
+// a nes2.0 header claims otherwise, so default to 8k
+func getPrgRAMAllocSize(cartInfo *CartInfo) int {
+	if size := cartInfo.GetRAMSizePrg() + cartInfo.GetNVRAMSizePrg(); size > 0 {
+		return size
+	}
+	return 8 * 1024
+}
+func getChrRAMAllocSize(cartInfo *CartInfo) int {
+	if size := cartInfo.GetRAMSizeChr() + cartInfo.GetNVRAMSizeChr(); size > 0 {
+		return size
+	}
+	return 8 * 1024
 }
 
-func (emu *emuState) init() {
+func (emu *emuState) init() (err error) {
+	defer recoverEmuErr(&err)
 	emu.Mem.mmc.Init(&emu.Mem)
-	emu.APU.init()
+	emu.APU.init(emu.timing(), emu.Mem.mmc.SoundChips())
+	return nil
 }
 
 // Joypad represents the buttons on a gamepad
@@ -148,7 +297,27 @@ type Joypad struct {
 	B     bool
 }
 
+// emuError is what emuErr panics with. It's recovered at
+// the edges of the Emulator API, so a misbehaving rom stops
+// the machine instead of taking down the host process.
+type emuError struct {
+	msg string
+}
+
+func (e emuError) Error() string { return e.msg }
+
 func emuErr(args ...interface{}) {
-	fmt.Println(args...)
-	os.Exit(1)
+	panic(emuError{msg: fmt.Sprint(args...)})
+}
+
+// recoverEmuErr must be deferred. It turns an emuErr panic
+// into an error in *err, and lets any other panic through.
+func recoverEmuErr(err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(emuError)
+		if !ok {
+			panic(r)
+		}
+		*err = e
+	}
 }
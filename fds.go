@@ -0,0 +1,668 @@
+package famigo
+
+import "fmt"
+
+const (
+	fdsSideLen = 65500
+
+	// a .fds image has no gaps or crcs between its blocks, so
+	// they're put back in for the drive to see. Lengths in bytes.
+	fdsLeadInGapLen = 28300 / 8
+	fdsBlockGapLen  = 976 / 8
+
+	fdsCyclesPerByte = 150   // ~96.4kbit/s
+	fdsSpinUpCycles  = 50000 // from the motor starting to the first byte
+)
+
+// IsFdsImage reports whether romBytes is a Famicom Disk System
+// disk image, either with an fwNES header or without one
+func IsFdsImage(romBytes []byte) bool {
+	if len(romBytes) >= 4 && string(romBytes[:4]) == "FDS\x1a" {
+		return true
+	}
+	return len(romBytes) >= 15 && romBytes[0] == 0x01 && string(romBytes[1:15]) == "*NINTENDO-HVC*"
+}
+
+func parseFdsImage(romBytes []byte) ([][]byte, error) {
+	if string(romBytes[:4]) == "FDS\x1a" {
+		if len(romBytes) < 16 {
+			return nil, fmt.Errorf("fds image too short")
+		}
+		romBytes = romBytes[16:]
+	}
+	numSides := len(romBytes) / fdsSideLen
+	if numSides == 0 {
+		return nil, fmt.Errorf("fds image too short")
+	}
+	var sides [][]byte
+	for i := 0; i < numSides; i++ {
+		sides = append(sides, romBytes[i*fdsSideLen:(i+1)*fdsSideLen])
+	}
+	return sides, nil
+}
+
+// loadFdsImage sets up the disk system's RAM adapter in place of
+// a cart. The header is made up, so the rest of the emulator can
+// treat it as mapper 20 with 32k of prg ram and 8k of chr ram.
+func loadFdsImage(romBytes []byte, bios []byte) (*CartInfo, []byte, mmc, error) {
+	if len(bios) == 0 {
+		return nil, nil, nil, fmt.Errorf("disk images need an fds bios")
+	}
+	if len(bios) != 8*1024 {
+		return nil, nil, nil, fmt.Errorf("fds bios should be 8k, got %v bytes", len(bios))
+	}
+	sides, err := parseFdsImage(romBytes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cartInfo, err := ParseCartInfo([]byte{
+		'N', 'E', 'S', 0x1a,
+		0x00, 0x00, // no prg or chr rom, chr ram it is
+		0x40, 0x18, // mapper 20, nes2.0
+		0x00, 0x00,
+		0x09, // 64<<9 = 32k prg ram
+		0x07, // 64<<7 = 8k chr ram
+		0x00, 0x00, 0x00, 0x00,
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	m := &mapper020{
+		DiskInserted:  true,
+		EndOfHead:     true,
+		VramMirroring: HorizontalMirroring,
+	}
+	for _, side := range sides {
+		m.Sides = append(m.Sides, addFdsGaps(side))
+	}
+	return cartInfo, bios, m, nil
+}
+
+// getFdsBlockLen returns the length of a block (including its type
+// byte), or 0 if it isn't one. Block 1 is the disk info, 2 the file
+// count, then each file is a header (3) and its data (4). The data
+// size is in the header, which is the last thing in prevBlocks.
+func getFdsBlockLen(blockType byte, prevBlocks []byte) int {
+	switch blockType {
+	case 1:
+		return 56
+	case 2:
+		return 2
+	case 3:
+		return 16
+	case 4:
+		if n := len(prevBlocks); n >= 16 && prevBlocks[n-16] == 3 {
+			return 1 + (int(prevBlocks[n-3]) | int(prevBlocks[n-2])<<8)
+		}
+	}
+	return 0
+}
+
+func addFdsGaps(side []byte) []byte {
+	raw := make([]byte, fdsLeadInGapLen)
+	i := 0
+	for i < len(side) {
+		blockLen := getFdsBlockLen(side[i], side[:i])
+		if blockLen == 0 || i+blockLen > len(side) {
+			break
+		}
+		raw = append(raw, 0x80) // gap end mark
+		raw = append(raw, side[i:i+blockLen]...)
+		raw = append(raw, 0x00, 0x00) // crc, never checked
+		raw = append(raw, make([]byte, fdsBlockGapLen)...)
+		i += blockLen
+	}
+	// keep the unused part of the side, for new files
+	return append(raw, make([]byte, fdsSideLen-i)...)
+}
+
+func removeFdsGaps(raw []byte) []byte {
+	side := make([]byte, 0, fdsSideLen)
+	pos := 0
+	for {
+		for pos < len(raw) && raw[pos] == 0x00 {
+			pos++
+		}
+		if pos+1 >= len(raw) || raw[pos] != 0x80 {
+			break
+		}
+		pos++
+		blockLen := getFdsBlockLen(raw[pos], side)
+		if blockLen == 0 || pos+blockLen > len(raw) || len(side)+blockLen > fdsSideLen {
+			break
+		}
+		side = append(side, raw[pos:pos+blockLen]...)
+		pos += blockLen + 2 // skip the crc
+	}
+	return append(side, make([]byte, fdsSideLen-len(side))...)
+}
+
+// mapper020 is the Famicom Disk System's RAM adapter: 32k of prg
+// ram, 8k of chr ram, the bios, a cpu cycle irq timer, the disk
+// drive, and the FDS sound channel.
+type mapper020 struct {
+	Sides       [][]byte // with gaps, as the drive sees them
+	DiskWritten bool     // since the last load
+
+	CurrentSide  int
+	DiskInserted bool
+	InsertDelay  int // cycles until a newly picked side goes in
+
+	LastEjectInput    bool
+	LastNextSideInput bool
+
+	DiskRegsEnabled  bool
+	SoundRegsEnabled bool
+
+	// $4025 flags
+	MotorOn         bool
+	ResetTransfer   bool
+	ReadMode        bool
+	CRCControl      bool
+	TransferEnabled bool // off while in a gap
+	DiskIRQEnabled  bool
+
+	ScanningDisk     bool
+	EndOfHead        bool
+	GapEnded         bool
+	DiskPos          int
+	Delay            int
+	ReadData         byte
+	WriteData        byte
+	TransferComplete bool
+	DiskIRQRequested bool
+
+	VramMirroring MirrorInfo
+
+	IRQReload    uint16
+	IRQCounter   uint16
+	IRQEnabled   bool
+	IRQRepeats   bool
+	IRQRequested bool
+
+	Audio fdsAudio
+}
+
+func (m *mapper020) Init(mem *mem)          {}
+func (m *mapper020) Marshal() marshalledMMC { return marshalMMC(20, m) }
+func (m *mapper020) ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte {
+	return m.ReadVRAM(mem, addr)
+}
+func (m *mapper020) ObservePPUAddr(emu *emuState, addr uint16) {}
+func (m *mapper020) SoundChips() []soundChip                   { return []soundChip{&m.Audio} }
+
+func (m *mapper020) RunCycle(emu *emuState) {
+	if m.IRQEnabled {
+		if m.IRQCounter == 0 {
+			m.IRQRequested = true
+			m.IRQCounter = m.IRQReload
+			m.IRQEnabled = m.IRQRepeats
+		} else {
+			m.IRQCounter--
+		}
+	}
+
+	m.updateDiskInput(emu)
+	m.runDrive()
+
+	if m.IRQRequested || m.DiskIRQRequested {
+		emu.CPU.IRQ = true // level triggered, held until ack'd
+	}
+}
+
+// updateDiskInput handles ejecting and swapping sides. A new
+// side goes in after a second out, so games notice the change.
+func (m *mapper020) updateDiskInput(emu *emuState) {
+	if emu.CurrentDiskEject && !m.LastEjectInput {
+		if m.DiskInserted || m.InsertDelay > 0 {
+			m.DiskInserted = false
+			m.InsertDelay = 0
+		} else {
+			m.DiskInserted = true
+		}
+	}
+	if emu.CurrentDiskNextSide && !m.LastNextSideInput {
+		m.CurrentSide = (m.CurrentSide + 1) % len(m.Sides)
+		m.DiskInserted = false
+		m.InsertDelay = emu.timing().cpuCyclesPerSecond
+	}
+	m.LastEjectInput = emu.CurrentDiskEject
+	m.LastNextSideInput = emu.CurrentDiskNextSide
+
+	if m.InsertDelay > 0 {
+		m.InsertDelay--
+		if m.InsertDelay == 0 {
+			m.DiskInserted = true
+		}
+	}
+}
+
+// runDrive moves a byte past the head every fdsCyclesPerByte
+// cycles, while the motor's on. Block crcs aren't emulated: the
+// bios is always told they're fine, and written ones are junk.
+func (m *mapper020) runDrive() {
+	if !m.DiskInserted || !m.MotorOn {
+		m.EndOfHead = true
+		m.ScanningDisk = false
+		return
+	}
+	if m.ResetTransfer && !m.ScanningDisk {
+		return
+	}
+	if m.EndOfHead {
+		m.Delay = fdsSpinUpCycles
+		m.EndOfHead = false
+		m.DiskPos = 0
+		m.GapEnded = false
+		return
+	}
+	if m.Delay > 0 {
+		m.Delay--
+		return
+	}
+
+	m.ScanningDisk = true
+	side := m.Sides[m.CurrentSide]
+	if m.ReadMode {
+		val := side[m.DiskPos]
+		needIRQ := m.DiskIRQEnabled
+		if !m.TransferEnabled {
+			m.GapEnded = false
+		} else if val != 0 && !m.GapEnded {
+			// no irq for the gap end mark, just the data after it
+			m.GapEnded = true
+			needIRQ = false
+		}
+		if m.GapEnded {
+			m.TransferComplete = true
+			m.ReadData = val
+			if needIRQ {
+				m.DiskIRQRequested = true
+			}
+		}
+	} else {
+		var val byte
+		if !m.CRCControl {
+			m.TransferComplete = true
+			val = m.WriteData
+			if m.DiskIRQEnabled {
+				m.DiskIRQRequested = true
+			}
+		}
+		if !m.TransferEnabled {
+			val = 0x00
+		}
+		side[m.DiskPos] = val
+		m.DiskWritten = true
+		m.GapEnded = false
+	}
+
+	m.DiskPos++
+	if m.DiskPos >= len(side) {
+		m.MotorOn = false
+	} else {
+		m.Delay = fdsCyclesPerByte
+	}
+}
+
+// getDiskImage returns the disk as a headerless .fds image
+func (m *mapper020) getDiskImage() []byte {
+	var image []byte
+	for _, side := range m.Sides {
+		image = append(image, removeFdsGaps(side)...)
+	}
+	return image
+}
+
+func (m *mapper020) setDiskImage(image []byte) error {
+	if len(image) != len(m.Sides)*fdsSideLen {
+		return fmt.Errorf("disk size mismatch")
+	}
+	for i := range m.Sides {
+		m.Sides[i] = addFdsGaps(image[i*fdsSideLen : (i+1)*fdsSideLen])
+	}
+	m.DiskWritten = false
+	return nil
+}
+
+func (m *mapper020) Read(mem *mem, addr uint16) byte {
+	switch {
+	case addr == 0x4030:
+		val := boolBit(m.IRQRequested, 0) | boolBit(m.TransferComplete, 1) | boolBit(m.EndOfHead, 6)
+		m.IRQRequested = false
+		m.TransferComplete = false
+		m.DiskIRQRequested = false
+		return val
+	case addr == 0x4031:
+		m.TransferComplete = false
+		m.DiskIRQRequested = false
+		return m.ReadData
+	case addr == 0x4032:
+		notInserted := !m.DiskInserted
+		notReady := notInserted || !m.ScanningDisk
+		return 0x40 | boolBit(notInserted, 2) | boolBit(notReady, 1) | boolBit(notInserted, 0)
+	case addr == 0x4033:
+		return 0x80 // battery's good
+	case addr >= 0x4040 && addr < 0x4100:
+		if m.SoundRegsEnabled {
+			return m.Audio.readReg(addr)
+		}
+	case addr >= 0x6000 && addr < 0xe000:
+		return mem.PrgRAM[addr-0x6000]
+	case addr >= 0xe000:
+		return mem.prgROM[addr-0xe000]
+	}
+	return 0xff
+}
+
+func (m *mapper020) Write(mem *mem, addr uint16, val byte) {
+	switch {
+	case addr == 0x4023:
+		m.DiskRegsEnabled = val&0x01 == 0x01
+		m.SoundRegsEnabled = val&0x02 == 0x02
+		if !m.DiskRegsEnabled {
+			m.IRQEnabled = false
+			m.IRQRequested = false
+			m.DiskIRQRequested = false
+		}
+	case addr >= 0x4020 && addr < 0x4027:
+		if m.DiskRegsEnabled {
+			m.writeDiskReg(addr, val)
+		}
+	case addr >= 0x4040 && addr < 0x4100:
+		if m.SoundRegsEnabled {
+			m.Audio.writeReg(addr, val)
+		}
+	case addr >= 0x6000 && addr < 0xe000:
+		mem.PrgRAM[addr-0x6000] = val
+	}
+}
+
+func (m *mapper020) writeDiskReg(addr uint16, val byte) {
+	switch addr {
+	case 0x4020:
+		m.IRQReload = m.IRQReload&0xff00 | uint16(val)
+	case 0x4021:
+		m.IRQReload = m.IRQReload&0x00ff | uint16(val)<<8
+	case 0x4022:
+		m.IRQRepeats = val&0x01 == 0x01
+		m.IRQEnabled = val&0x02 == 0x02
+		if m.IRQEnabled {
+			m.IRQCounter = m.IRQReload
+		} else {
+			m.IRQRequested = false
+		}
+	case 0x4024:
+		m.WriteData = val
+		m.TransferComplete = false
+		m.DiskIRQRequested = false
+	case 0x4025:
+		m.MotorOn = val&0x01 == 0x01
+		m.ResetTransfer = val&0x02 == 0x02
+		m.ReadMode = val&0x04 == 0x04
+		if val&0x08 == 0x08 {
+			m.VramMirroring = HorizontalMirroring
+		} else {
+			m.VramMirroring = VerticalMirroring
+		}
+		m.CRCControl = val&0x10 == 0x10
+		m.TransferEnabled = val&0x40 == 0x40
+		m.DiskIRQEnabled = val&0x80 == 0x80
+		m.DiskIRQRequested = false
+	}
+}
+
+func (m *mapper020) getVRAMAddr(addr uint16) uint16 {
+	if m.VramMirroring == VerticalMirroring {
+		return vertMirrorVRAMAddr(addr)
+	}
+	return horizMirrorVRAMAddr(addr)
+}
+
+func (m *mapper020) ReadVRAM(mem *mem, addr uint16) byte {
+	var val byte
+	switch {
+	case addr < 0x2000:
+		val = mem.chrROM[addr]
+	case addr >= 0x2000 && addr < 0x3000:
+		val = mem.InternalVRAM[m.getVRAMAddr(addr)]
+	default:
+		emuErr(fmt.Sprintf("mapper020: unimplemented vram access: read(%04x)", addr))
+	}
+	return val
+}
+
+func (m *mapper020) WriteVRAM(mem *mem, addr uint16, val byte) {
+	switch {
+	case addr < 0x2000:
+		mem.chrROM[addr] = val
+	case addr >= 0x2000 && addr < 0x3000:
+		mem.InternalVRAM[m.getVRAMAddr(addr)] = val
+	default:
+		emuErr(fmt.Sprintf("mapper020: unimplemented vram access: write(%04x, %02x)", addr, val))
+	}
+}
+
+// fdsAudio is the disk system's sound: one channel playing a 64
+// step, 6-bit wavetable, with a volume envelope, and a second
+// table that bends its pitch (with its own envelope for depth).
+type fdsAudio struct {
+	Wave         [64]byte
+	WaveWritable bool // also holds the output where it is
+	MasterVolume byte
+
+	Freq       uint16 // 12 bits
+	WaveHalted bool
+	EnvsHalted bool
+	WaveAccum  uint32 // top 6 of 22 bits are the wave position
+
+	VolEnv   fdsEnvelope
+	ModEnv   fdsEnvelope
+	EnvSpeed byte // multiplies both envelope periods
+
+	ModTable   [64]byte // 3 bits each
+	ModPos     byte
+	ModFreq    uint16 // 12 bits
+	ModHalted  bool
+	ModAccum   uint32
+	ModCounter int // 7 bit signed
+
+	Output int
+}
+
+type fdsEnvelope struct {
+	Speed    byte
+	Gain     byte
+	Increase bool
+	Disabled bool
+	Timer    int
+}
+
+// out of 30, for a quick integer multiply
+var fdsMasterVolumes = [4]int{30, 20, 15, 12}
+
+// what each mod table value does to the mod counter,
+// with 4 (reset to zero) handled separately
+var fdsModAdjustments = [8]int{0, 1, 2, 4, 0, -4, -2, -1}
+
+// a full volume, full swing wave comes out
+// a bit over twice as loud as an apu pulse
+const fdsLevelScale = apuPulseStep * 15 * 2.4 / (63 * 32 * 30)
+
+func (f *fdsAudio) channelNames() []string {
+	return []string{"FDS"}
+}
+
+func (f *fdsAudio) readReg(addr uint16) byte {
+	switch {
+	case addr >= 0x4040 && addr < 0x4080:
+		return 0x40 | f.Wave[addr-0x4040]
+	case addr == 0x4090:
+		return 0x40 | f.VolEnv.Gain
+	case addr == 0x4092:
+		return 0x40 | f.ModEnv.Gain
+	}
+	return 0xff
+}
+
+func (f *fdsAudio) writeReg(addr uint16, val byte) {
+	switch {
+	case addr >= 0x4040 && addr < 0x4080:
+		if f.WaveWritable {
+			f.Wave[addr-0x4040] = val & 0x3f
+		}
+	case addr == 0x4080:
+		f.VolEnv.write(val)
+	case addr == 0x4082:
+		f.Freq = f.Freq&0x0f00 | uint16(val)
+	case addr == 0x4083:
+		f.Freq = f.Freq&0x00ff | uint16(val&0x0f)<<8
+		f.EnvsHalted = val&0x40 == 0x40
+		f.WaveHalted = val&0x80 == 0x80
+		if f.WaveHalted {
+			f.WaveAccum = 0
+		}
+		if f.EnvsHalted {
+			f.VolEnv.resetTimer(f.EnvSpeed)
+			f.ModEnv.resetTimer(f.EnvSpeed)
+		}
+	case addr == 0x4084:
+		f.ModEnv.write(val)
+	case addr == 0x4085:
+		f.ModCounter = int(val&0x3f) - int(val&0x40)
+	case addr == 0x4086:
+		f.ModFreq = f.ModFreq&0x0f00 | uint16(val)
+	case addr == 0x4087:
+		f.ModFreq = f.ModFreq&0x00ff | uint16(val&0x0f)<<8
+		f.ModHalted = val&0x80 == 0x80
+		if f.ModHalted {
+			f.ModAccum = 0
+		}
+	case addr == 0x4088:
+		// each write fills two entries, only while halted
+		if f.ModHalted {
+			f.ModTable[f.ModPos] = val & 0x07
+			f.ModTable[f.ModPos+1] = val & 0x07
+			f.ModPos = (f.ModPos + 2) & 0x3f
+		}
+	case addr == 0x4089:
+		f.WaveWritable = val&0x80 == 0x80
+		f.MasterVolume = val & 0x03
+	case addr == 0x408a:
+		f.EnvSpeed = val
+	}
+}
+
+func (e *fdsEnvelope) write(val byte) {
+	e.Speed = val & 0x3f
+	e.Increase = val&0x40 == 0x40
+	e.Disabled = val&0x80 == 0x80
+	if e.Disabled {
+		e.Gain = e.Speed
+	}
+}
+
+func (e *fdsEnvelope) resetTimer(envSpeed byte) {
+	e.Timer = 8 * (int(e.Speed) + 1) * int(envSpeed)
+}
+
+func (e *fdsEnvelope) runCycle(envSpeed byte) {
+	if e.Disabled {
+		return
+	}
+	if e.Timer > 0 {
+		e.Timer--
+		return
+	}
+	e.resetTimer(envSpeed)
+	if e.Increase && e.Gain < 32 {
+		e.Gain++
+	} else if !e.Increase && e.Gain > 0 {
+		e.Gain--
+	}
+}
+
+func (f *fdsAudio) runCycle() {
+	if !f.EnvsHalted && !f.WaveHalted && f.EnvSpeed != 0 {
+		f.VolEnv.runCycle(f.EnvSpeed)
+		f.ModEnv.runCycle(f.EnvSpeed)
+	}
+
+	if !f.ModHalted {
+		f.ModAccum += uint32(f.ModFreq)
+		if f.ModAccum >= 0x10000 {
+			f.ModAccum &= 0xffff
+			f.stepModTable()
+		}
+	}
+
+	if f.WaveWritable {
+		return // output holds
+	}
+	if !f.WaveHalted {
+		f.WaveAccum = (f.WaveAccum + uint32(f.getPitch())) & 0x3fffff
+	}
+	gain := int(f.VolEnv.Gain)
+	if gain > 32 {
+		gain = 32
+	}
+	f.Output = int(f.Wave[f.WaveAccum>>16]) * gain * fdsMasterVolumes[f.MasterVolume]
+}
+
+func (f *fdsAudio) stepModTable() {
+	val := f.ModTable[f.ModPos]
+	f.ModPos = (f.ModPos + 1) & 0x3f
+	if val == 4 {
+		f.ModCounter = 0
+	} else {
+		// wraps at 7 bits
+		f.ModCounter = (f.ModCounter+fdsModAdjustments[val]+64)&0x7f - 64
+	}
+}
+
+// getPitch is the wave frequency after modulation, using
+// the same rounding the hardware does (as worked out on nesdev)
+func (f *fdsAudio) getPitch() int {
+	pitch := int(f.Freq)
+	if f.ModHalted {
+		return pitch
+	}
+	temp := f.ModCounter * int(f.ModEnv.Gain)
+	remainder := temp & 0x0f
+	temp >>= 4
+	if remainder > 0 && temp&0x80 == 0 {
+		if f.ModCounter < 0 {
+			temp--
+		} else {
+			temp += 2
+		}
+	}
+	if temp >= 192 {
+		temp -= 256
+	} else if temp < -64 {
+		temp += 256
+	}
+	temp *= pitch
+	remainder = temp & 0x3f
+	temp >>= 6
+	if remainder >= 32 {
+		temp++
+	}
+	return maxInt(pitch+temp, 0)
+}
+
+func (f *fdsAudio) getOutputs(outputs []float64) {
+	outputs[0] = float64(f.Output) * fdsLevelScale
+}
+
+func (f *fdsAudio) getNotes(notes []channelNote) {
+	gain := minInt(int(f.VolEnv.Gain), 32)
+	if f.WaveHalted || f.Freq == 0 || gain == 0 {
+		notes[0] = channelNote{}
+		return
+	}
+	// the wave position is the top 6 of 22 bits, stepped by
+	// the pitch every cycle. Modulation's left out.
+	volume := float64(gain) / 32 * float64(fdsMasterVolumes[f.MasterVolume]) / 30
+	notes[0] = channelNote{Period: float64(1<<22) / float64(f.Freq), Volume: volume}
+}
@@ -0,0 +1,330 @@
+package famigo
+
+import (
+	"fmt"
+	"math"
+)
+
+// mapper069 is Sunsoft's FME-7, and the 5B, which
+// is the same mapper with extra sound.
+type mapper069 struct {
+	IsChrRAM bool
+
+	Command byte
+
+	ChrBanks [8]int // 1k each
+	PrgBanks [3]int // $8000, $a000, $c000, in 8k units
+
+	// $6000-$7fff can be rom or ram
+	PrgBank6000Number int
+	PrgBank6000IsRAM  bool
+	PrgRAMEnabled     bool
+
+	VramMirroring MirrorInfo
+
+	IRQEnabled        bool
+	IRQCounterEnabled bool
+	IRQCounter        uint16
+	IRQRequested      bool
+
+	Audio sunsoft5BAudio
+}
+
+func (m *mapper069) Init(mem *mem)          {}
+func (m *mapper069) Marshal() marshalledMMC { return marshalMMC(69, m) }
+func (m *mapper069) ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte {
+	return m.ReadVRAM(mem, addr)
+}
+func (m *mapper069) ObservePPUAddr(emu *emuState, addr uint16) {}
+func (m *mapper069) SoundChips() []soundChip                   { return []soundChip{&m.Audio} }
+
+func (m *mapper069) RunCycle(emu *emuState) {
+	if m.IRQCounterEnabled {
+		m.IRQCounter--
+		if m.IRQCounter == 0xffff && m.IRQEnabled {
+			m.IRQRequested = true
+		}
+	}
+	if m.IRQRequested {
+		emu.CPU.IRQ = true // level triggered, held until ack'd
+	}
+}
+
+func (m *mapper069) Read(mem *mem, addr uint16) byte {
+	switch {
+	case addr >= 0x6000 && addr < 0x8000:
+		if !m.PrgBank6000IsRAM {
+			return mem.prgROM[m.PrgBank6000Number*8*1024+int(addr-0x6000)]
+		}
+		if m.PrgRAMEnabled {
+			return mem.PrgRAM[int(addr-0x6000)&(len(mem.PrgRAM)-1)]
+		}
+		return 0xff
+	case addr >= 0x8000 && addr < 0xe000:
+		slot := int(addr-0x8000) / (8 * 1024)
+		return mem.prgROM[m.PrgBanks[slot]*8*1024+int(addr&0x1fff)]
+	case addr >= 0xe000:
+		offset := len(mem.prgROM) - 8*1024 // last bank
+		return mem.prgROM[offset+int(addr-0xe000)]
+	}
+	return 0xff
+}
+
+func (m *mapper069) Write(mem *mem, addr uint16, val byte) {
+	switch {
+	case addr >= 0x6000 && addr < 0x8000:
+		if m.PrgBank6000IsRAM && m.PrgRAMEnabled {
+			mem.PrgRAM[int(addr-0x6000)&(len(mem.PrgRAM)-1)] = val
+		}
+	case addr >= 0x8000 && addr < 0xa000:
+		m.Command = val & 0x0f
+	case addr >= 0xa000 && addr < 0xc000:
+		m.writeParameter(mem, val)
+	case addr >= 0xc000 && addr < 0xe000:
+		m.Audio.writeAddr(val)
+	case addr >= 0xe000:
+		m.Audio.writeData(val)
+	}
+}
+
+func (m *mapper069) writeParameter(mem *mem, val byte) {
+	switch {
+	case m.Command < 8:
+		m.ChrBanks[m.Command] = wrapBank(int(val), mem.chrROM, 1024)
+	case m.Command == 8:
+		m.PrgBank6000Number = wrapBank(int(val&0x3f), mem.prgROM, 8*1024)
+		m.PrgBank6000IsRAM = val&0x40 == 0x40
+		m.PrgRAMEnabled = val&0x80 == 0x80
+	case m.Command < 0x0c:
+		m.PrgBanks[m.Command-9] = wrapBank(int(val&0x3f), mem.prgROM, 8*1024)
+	case m.Command == 0x0c:
+		switch val & 0x03 {
+		case 0:
+			m.VramMirroring = VerticalMirroring
+		case 1:
+			m.VramMirroring = HorizontalMirroring
+		case 2:
+			m.VramMirroring = OneScreenLowerMirroring
+		case 3:
+			m.VramMirroring = OneScreenUpperMirroring
+		}
+	case m.Command == 0x0d:
+		m.IRQEnabled = val&0x01 == 0x01
+		m.IRQCounterEnabled = val&0x80 == 0x80
+		m.IRQRequested = false
+	case m.Command == 0x0e:
+		m.IRQCounter = m.IRQCounter&0xff00 | uint16(val)
+	case m.Command == 0x0f:
+		m.IRQCounter = m.IRQCounter&0x00ff | uint16(val)<<8
+	}
+}
+
+func (m *mapper069) getVRAMAddr(addr uint16) uint16 {
+	switch m.VramMirroring {
+	case VerticalMirroring:
+		return vertMirrorVRAMAddr(addr)
+	case HorizontalMirroring:
+		return horizMirrorVRAMAddr(addr)
+	case OneScreenLowerMirroring:
+		return oneScreenLowerVRAMAddr(addr)
+	default:
+		return oneScreenUpperVRAMAddr(addr)
+	}
+}
+
+func (m *mapper069) ReadVRAM(mem *mem, addr uint16) byte {
+	var val byte
+	switch {
+	case addr < 0x2000:
+		val = mem.chrROM[m.ChrBanks[addr>>10]*1024+int(addr&0x03ff)]
+	case addr >= 0x2000 && addr < 0x3000:
+		val = mem.InternalVRAM[m.getVRAMAddr(addr)]
+	default:
+		emuErr(fmt.Sprintf("mapper069: unimplemented vram access: read(%04x)", addr))
+	}
+	return val
+}
+
+func (m *mapper069) WriteVRAM(mem *mem, addr uint16, val byte) {
+	switch {
+	case addr < 0x2000:
+		if m.IsChrRAM {
+			mem.chrROM[m.ChrBanks[addr>>10]*1024+int(addr&0x03ff)] = val
+		}
+	case addr >= 0x2000 && addr < 0x3000:
+		mem.InternalVRAM[m.getVRAMAddr(addr)] = val
+	default:
+		emuErr(fmt.Sprintf("mapper069: unimplemented vram access: write(%04x, %02x)", addr, val))
+	}
+}
+
+// sunsoft5BAudio is the 5B's YM2149F (an AY-3-8910 clone): three
+// squares, each of which can have noise mixed in, and which share
+// a single envelope generator. Volume is logarithmic.
+type sunsoft5BAudio struct {
+	Addr byte
+	Regs [16]byte
+
+	ToneCounters [3]int
+	ToneOutputs  [3]bool
+
+	NoiseCounter int
+	NoiseLFSR    uint32 // 17 bits
+	NoiseOutput  bool
+
+	EnvCounter int
+	EnvStep    byte // 0-31
+	EnvAttack  bool
+	EnvHolding bool
+}
+
+// 1.5dB per step, 32 steps (4-bit volumes use every other one)
+var sunsoft5BVolumes = makeSunsoft5BVolumes()
+
+func makeSunsoft5BVolumes() [32]float64 {
+	var volumes [32]float64
+	for i := 1; i < 32; i++ {
+		volumes[i] = math.Pow(10, float64(i-31)*1.5/20)
+	}
+	return volumes
+}
+
+// a channel at full volume comes out
+// a bit louder than a full apu pulse
+const sunsoft5BLevelScale = apuPulseStep * 15 * 1.5
+
+func (s *sunsoft5BAudio) channelNames() []string {
+	return []string{"5B Square A", "5B Square B", "5B Square C"}
+}
+
+func (s *sunsoft5BAudio) writeAddr(val byte) {
+	s.Addr = val & 0x0f
+}
+
+func (s *sunsoft5BAudio) writeData(val byte) {
+	s.Regs[s.Addr] = val
+	if s.Addr == 0x0d {
+		// restarts the envelope
+		s.EnvCounter = 0
+		s.EnvStep = 0
+		s.EnvAttack = val&0x04 == 0x04
+		s.EnvHolding = false
+	}
+}
+
+func (s *sunsoft5BAudio) runCycle() {
+	if s.NoiseLFSR == 0 {
+		s.NoiseLFSR = 1 // power on state
+	}
+
+	// squares toggle every 16*period cycles
+	for c := 0; c < 3; c++ {
+		period := int(s.Regs[c*2+1]&0x0f)<<8 | int(s.Regs[c*2])
+		s.ToneCounters[c]++
+		if s.ToneCounters[c] >= 16*maxInt(period, 1) {
+			s.ToneCounters[c] = 0
+			s.ToneOutputs[c] = !s.ToneOutputs[c]
+		}
+	}
+
+	noisePeriod := int(s.Regs[6] & 0x1f)
+	s.NoiseCounter++
+	if s.NoiseCounter >= 16*maxInt(noisePeriod, 1) {
+		s.NoiseCounter = 0
+		bit := (s.NoiseLFSR ^ (s.NoiseLFSR >> 3)) & 0x01
+		s.NoiseLFSR = (s.NoiseLFSR >> 1) | (bit << 16)
+		s.NoiseOutput = s.NoiseLFSR&0x01 == 0x01
+	}
+
+	envPeriod := int(s.Regs[0x0c])<<8 | int(s.Regs[0x0b])
+	s.EnvCounter++
+	if s.EnvCounter >= 8*maxInt(envPeriod, 1) {
+		s.EnvCounter = 0
+		s.clockEnvelope()
+	}
+}
+
+func (s *sunsoft5BAudio) clockEnvelope() {
+	if s.EnvHolding {
+		return
+	}
+	s.EnvStep++
+	if s.EnvStep < 32 {
+		return
+	}
+	shape := s.Regs[0x0d]
+	continues := shape&0x08 == 0x08
+	alternates := shape&0x02 == 0x02
+	holds := shape&0x01 == 0x01
+	switch {
+	case !continues:
+		s.EnvHolding = true
+		s.EnvStep = 31
+		s.EnvAttack = false // ends at zero
+	case holds:
+		s.EnvHolding = true
+		s.EnvStep = 31
+		if alternates {
+			s.EnvAttack = !s.EnvAttack
+		}
+	default:
+		s.EnvStep = 0
+		if alternates {
+			s.EnvAttack = !s.EnvAttack
+		}
+	}
+}
+
+func (s *sunsoft5BAudio) getEnvelopeLevel() byte {
+	if s.EnvAttack {
+		return s.EnvStep
+	}
+	return 31 - s.EnvStep
+}
+
+func (s *sunsoft5BAudio) getOutputs(outputs []float64) {
+	mixer := s.Regs[7]
+	for c := 0; c < 3; c++ {
+		toneOn := s.ToneOutputs[c] || mixer&(0x01<<c) != 0
+		noiseOn := s.NoiseOutput || mixer&(0x08<<c) != 0
+		if !toneOn || !noiseOn {
+			outputs[c] = 0
+			continue
+		}
+		var level byte
+		if vol := s.Regs[8+c]; vol&0x10 == 0x10 {
+			level = s.getEnvelopeLevel()
+		} else if vol&0x0f != 0 {
+			level = (vol&0x0f)*2 + 1
+		}
+		outputs[c] = sunsoft5BVolumes[level] * sunsoft5BLevelScale
+	}
+}
+
+func (s *sunsoft5BAudio) getNotes(notes []channelNote) {
+	mixer := s.Regs[7]
+	for c := 0; c < 3; c++ {
+		notes[c] = channelNote{}
+		period := int(s.Regs[c*2+1]&0x0f)<<8 | int(s.Regs[c*2])
+		if mixer&(0x01<<c) != 0 || period == 0 {
+			continue // tone off, noise alone has no pitch
+		}
+		var volume float64
+		if vol := s.Regs[8+c]; vol&0x10 == 0x10 {
+			volume = float64(s.getEnvelopeLevel()) / 31
+		} else {
+			volume = float64(vol&0x0f) / 15
+		}
+		if volume > 0 {
+			// the square toggles every 16*period cycles
+			notes[c] = channelNote{Period: 32 * float64(period), Volume: volume}
+		}
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
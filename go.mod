@@ -3,6 +3,9 @@ module github.com/theinternetftw/famigo
 go 1.18
 
 require (
+	// used directly for the mouse (see cmd/famigo/mouse.go),
+	// keep this at the version glimmer requires
+	github.com/hajimehoshi/ebiten/v2 v2.6.3
 	github.com/pkg/profile v1.2.1
 	github.com/theinternetftw/cpugo/virt6502 v0.0.1
 	github.com/theinternetftw/glimmer v0.1.1
@@ -11,7 +14,6 @@ require (
 require (
 	github.com/ebitengine/oto/v3 v3.1.0 // indirect
 	github.com/ebitengine/purego v0.5.0 // indirect
-	github.com/hajimehoshi/ebiten/v2 v2.6.3 // indirect
 	github.com/jezek/xgb v1.1.0 // indirect
 	golang.org/x/exp/shiny v0.0.0-20230817173708-d852ddb80c63 // indirect
 	golang.org/x/image v0.12.0 // indirect
@@ -0,0 +1,87 @@
+package famigo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// Shared bits for tests that need a tune to play. The nsfs are
+// built here from a few hand-assembled 6502 snippets, so what
+// each test plays is right there in the test.
+
+const (
+	testNsfInitAddr = 0x8000
+	testNsfPlayAddr = 0x8100
+)
+
+// makeTestNsf builds a one-track nsf with init and play loaded at
+// testNsfInitAddr and testNsfPlayAddr. Both should end in asmRTS.
+func makeTestNsf(chipFlags byte, init, play []byte) []byte {
+	hdr := nsfHeader{
+		Version:        1,
+		NumSongs:       1,
+		StartSong:      1,
+		LoadAddr:       testNsfInitAddr,
+		InitAddr:       testNsfInitAddr,
+		PlayAddr:       testNsfPlayAddr,
+		PlaySpeedNtsc:  16639,
+		PlaySpeedPal:   19997,
+		SoundChipFlags: chipFlags,
+	}
+	copy(hdr.Magic[:], "NESM\x1a")
+	copy(hdr.SongName[:], "famigo test")
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, &hdr)
+	code := make([]byte, 0x200)
+	copy(code, init)
+	copy(code[testNsfPlayAddr-testNsfInitAddr:], play)
+	buf.Write(code)
+	return buf.Bytes()
+}
+
+// asm joins snippets into one block of code
+func asm(snippets ...[]byte) []byte {
+	return bytes.Join(snippets, nil)
+}
+
+var asmRTS = []byte{0x60}
+
+// asmStore is LDA #val, STA addr
+func asmStore(addr uint16, val byte) []byte {
+	return []byte{0xa9, val, 0x8d, byte(addr), byte(addr >> 8)}
+}
+
+// asmCountFrame is INC $00, LDA $00, so A holds a frame count
+var asmCountFrame = []byte{0xe6, 0x00, 0xa5, 0x00}
+
+// asmStoreA is STA addr
+func asmStoreA(addr uint16) []byte {
+	return []byte{0x8d, byte(addr), byte(addr >> 8)}
+}
+
+// renderTestTrack is RenderNsfTrack, for the nsf's only track
+func renderTestTrack(t *testing.T, nsf []byte, length, fadeLength time.Duration, opts Options) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := RenderNsfTrack(buf, nsf, 0, length, fadeLength, opts); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pcmRMS is the loudness of some 16-bit pcm, from 0 to 1
+func pcmRMS(pcm []byte) float64 {
+	if len(pcm) < 2 {
+		return 0
+	}
+	sum := 0.0
+	for i := 0; i+2 <= len(pcm); i += 2 {
+		s := float64(int16(binary.LittleEndian.Uint16(pcm[i:]))) / 32767
+		sum += s * s
+	}
+	return math.Sqrt(sum / float64(len(pcm)/2))
+}
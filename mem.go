@@ -92,11 +92,11 @@ func (emu *emuState) write(addr uint16, val byte) {
 	case addr == 0x400d:
 		// nop
 	case addr == 0x400e:
-		emu.APU.Noise.writeNoiseControlReg(val)
+		emu.APU.Noise.writeNoiseControlReg(val, emu.timing())
 	case addr == 0x400f:
 		emu.APU.Noise.writeNoiseLength(val)
 	case addr == 0x4010:
-		emu.APU.DMC.writeDMCFlagsAndRate(val)
+		emu.APU.DMC.writeDMCFlagsAndRate(val, emu.timing())
 	case addr == 0x4011:
 		emu.APU.DMC.writeDMCCurrentValue(val)
 	case addr == 0x4012:
@@ -143,7 +143,7 @@ func (emu *emuState) ppuRead(addr uint16) byte {
 	case 0x06:
 		return emu.PPU.readAddrReg()
 	case 0x07:
-		return emu.PPU.readDataReg(&emu.Mem)
+		return emu.PPU.readDataReg(emu)
 	default:
 		emuErr(fmt.Sprintf("PPU not implemented, read at %04x", realAddr))
 	}
@@ -165,9 +165,9 @@ func (emu *emuState) ppuWrite(addr uint16, val byte) {
 	case 0x05:
 		emu.PPU.writeScrollReg(val)
 	case 0x06:
-		emu.PPU.writeAddrReg(val)
+		emu.PPU.writeAddrReg(emu, val)
 	case 0x07:
-		emu.PPU.writeDataReg(&emu.Mem, val)
+		emu.PPU.writeDataReg(emu, val)
 	default:
 		emuErr(fmt.Sprintf("PPU not implemented, write(%04x, %02x)", realAddr, val))
 	}
@@ -0,0 +1,114 @@
+package famigo
+
+import (
+	"fmt"
+	"math"
+)
+
+// ChannelMix is how a single sound channel is mixed into the output
+type ChannelMix struct {
+	Name   string // set by the emulator, changes are ignored
+	Muted  bool
+	Solo   bool    // when any channel is soloed, only soloed channels are heard
+	Volume float64 // 1.0 is unchanged, from 0 up to MaxChannelVolume
+	Pan    float64 // -1.0 is hard left, 1.0 is hard right, 0 is center
+}
+
+// MaxChannelVolume is the loudest a ChannelMix can be turned up.
+// Much past this and a single channel can clip the whole mix.
+const MaxChannelVolume = 2.0
+
+// mixer holds the user's channel settings. It's not part of the
+// emulated machine, so it's not snapshotted.
+type mixer struct {
+	channels []ChannelMix
+	gains    [2][]float64 // what's actually applied to left and right, from channels
+	changed  bool
+}
+
+const (
+	pulse1Channel = iota
+	pulse2Channel
+	triangleChannel
+	noiseChannel
+	dmcChannel
+	numAPUChannels
+)
+
+var apuChannelNames = [numAPUChannels]string{
+	"Pulse 1", "Pulse 2", "Triangle", "Noise", "DMC",
+}
+
+// pulses spread apart, triangle kept center for the bass,
+// noise and dmc nudged opposite ways to balance the drums
+var wideStereoPans = [numAPUChannels]float64{
+	pulse1Channel:   -0.6,
+	pulse2Channel:   0.6,
+	triangleChannel: 0,
+	noiseChannel:    0.3,
+	dmcChannel:      -0.3,
+}
+
+func (m *mixer) init(names []string) {
+	m.channels = m.channels[:0]
+	for _, name := range names {
+		m.channels = append(m.channels, ChannelMix{Name: name, Volume: 1})
+	}
+	m.updateGains()
+}
+
+func (m *mixer) getChannelMix() []ChannelMix {
+	return append([]ChannelMix{}, m.channels...)
+}
+
+func (m *mixer) setChannelMix(i int, cm ChannelMix) error {
+	if i < 0 || i >= len(m.channels) {
+		return fmt.Errorf("no sound channel at index %v", i)
+	}
+	// NaN gets past every range check below, and would end up in all the gains
+	if !isFinite(cm.Volume) || !isFinite(cm.Pan) {
+		return fmt.Errorf("channel volume and pan must be finite numbers")
+	}
+	if cm.Volume < 0 || cm.Volume > MaxChannelVolume {
+		return fmt.Errorf("channel volume must be between 0 and %v", MaxChannelVolume)
+	}
+	if cm.Pan < -1 || cm.Pan > 1 {
+		return fmt.Errorf("channel pan must be between -1 and 1")
+	}
+	cm.Name = m.channels[i].Name
+	m.channels[i] = cm
+	m.updateGains()
+	return nil
+}
+
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+func (m *mixer) applyWideStereo() {
+	for i, pan := range wideStereoPans {
+		m.channels[i].Pan = pan
+	}
+	m.updateGains()
+}
+
+func (m *mixer) updateGains() {
+	anySolo := false
+	for _, c := range m.channels {
+		anySolo = anySolo || c.Solo
+	}
+	m.gains[0], m.gains[1] = m.gains[0][:0], m.gains[1][:0]
+	for _, c := range m.channels {
+		gain := c.Volume
+		if c.Muted || (anySolo && !c.Solo) {
+			gain = 0
+		}
+		// balance rather than constant power, so a centered
+		// channel sounds exactly as it does in mono
+		left := gain * math.Min(1, 1-c.Pan)
+		right := gain * math.Min(1, 1+c.Pan)
+		m.gains[0] = append(m.gains[0], left)
+		m.gains[1] = append(m.gains[1], right)
+	}
+	m.changed = true
+}
@@ -0,0 +1,35 @@
+package famigo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSetChannelMixRejectsBadValues(t *testing.T) {
+	var m mixer
+	m.init(apuChannelNames[:])
+	bad := []ChannelMix{
+		{Volume: math.NaN()},
+		{Volume: math.Inf(1)},
+		{Volume: math.Inf(-1)},
+		{Volume: -0.5},
+		{Volume: MaxChannelVolume + 0.5},
+		{Volume: 1, Pan: math.NaN()},
+		{Volume: 1, Pan: math.Inf(1)},
+		{Volume: 1, Pan: math.Inf(-1)},
+		{Volume: 1, Pan: 1.5},
+	}
+	for _, cm := range bad {
+		if err := m.setChannelMix(0, cm); err == nil {
+			t.Errorf("volume %v, pan %v was accepted", cm.Volume, cm.Pan)
+		}
+	}
+	if gain := m.gains[0][0]; gain != m.gains[1][0] || math.IsNaN(gain) {
+		t.Errorf("rejected settings changed the gains: %v, %v", m.gains[0][0], m.gains[1][0])
+	}
+
+	good := ChannelMix{Volume: MaxChannelVolume, Pan: -1}
+	if err := m.setChannelMix(0, good); err != nil {
+		t.Errorf("volume %v, pan %v was rejected: %v", good.Volume, good.Pan, err)
+	}
+}
@@ -5,41 +5,63 @@ import (
 	"fmt"
 )
 
-func makeMMC(cartInfo *CartInfo) mmc {
+func makeMMC(cartInfo *CartInfo) (mmc, error) {
 	mapperNum := cartInfo.GetMapperNumber()
 	switch mapperNum {
 	case 0:
 		return &mapper000{
 			VramMirroring: cartInfo.GetMirrorInfo(),
 			IsChrRAM:      cartInfo.IsChrRAM(),
-		}
+		}, nil
 	case 1:
 		return &mapper001{
 			VramMirroring: cartInfo.GetMirrorInfo(),
 			IsChrRAM:      cartInfo.IsChrRAM(),
-		}
+		}, nil
 	case 2:
 		return &mapper002{
 			VramMirroring: cartInfo.GetMirrorInfo(),
 			IsChrRAM:      cartInfo.IsChrRAM(),
-		}
+		}, nil
 	case 3:
 		return &mapper003{
 			VramMirroring: cartInfo.GetMirrorInfo(),
 			IsChrRAM:      cartInfo.IsChrRAM(),
-		}
+		}, nil
 	case 4:
-		return &mapper004{}
+		return &mapper004{
+			IRQUsesRevABehavior: cartInfo.GetSubmapperNumber() == 4,
+		}, nil
+	case 5:
+		return &mapper005{
+			IsChrRAM: cartInfo.IsChrRAM(),
+		}, nil
 	case 7:
-		return &mapper007{}
+		return &mapper007{}, nil
+	case 19:
+		return &mapper019{
+			IsChrRAM: cartInfo.IsChrRAM(),
+		}, nil
+	case 24, 26:
+		return &mapper024{
+			SwapsA0A1: mapperNum == 26,
+			IsChrRAM:  cartInfo.IsChrRAM(),
+		}, nil
 	case 31:
 		return &mapper031{
 			VramMirroring: cartInfo.GetMirrorInfo(),
 			IsChrRAM:      cartInfo.IsChrRAM(),
-		}
+		}, nil
+	case 69:
+		return &mapper069{
+			IsChrRAM: cartInfo.IsChrRAM(),
+		}, nil
+	case 85:
+		return &mapper085{
+			IsChrRAM: cartInfo.IsChrRAM(),
+		}, nil
 	default:
-		emuErr(fmt.Sprintf("makeMMC: unimplemented mapper number %v", mapperNum))
-		panic("unreachable code")
+		return nil, fmt.Errorf("makeMMC: unimplemented mapper number %v", mapperNum)
 	}
 }
 
@@ -51,9 +73,33 @@ type mmc interface {
 	WriteVRAM(mem *mem, addr uint16, val byte)
 	RunCycle(emu *emuState)
 
+	// ReadVRAMForRender is used instead of ReadVRAM for fetches
+	// the ppu makes while rendering, for mappers that need to
+	// know what each fetch is for.
+	ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte
+
+	// ObservePPUAddr is called with every address the ppu puts
+	// on its bus, for mappers that watch it (e.g. to count A12
+	// rises).
+	ObservePPUAddr(emu *emuState, addr uint16)
+
+	// SoundChips returns the cart's expansion sound, if any
+	SoundChips() []soundChip
+
 	Marshal() marshalledMMC
 }
 
+// wrapBank picks which of a rom's banks a bank reg val points at.
+// It wraps with a modulo instead of a mask, so roms whose size isn't
+// a power of two still land on a real bank.
+func wrapBank(val int, rom []byte, bankSize int) int {
+	numBanks := len(rom) / bankSize
+	if numBanks <= 0 {
+		return 0
+	}
+	return val % numBanks
+}
+
 func unmarshalMMC(m marshalledMMC) (mmc, error) {
 	var mmc mmc
 	switch m.Number {
@@ -67,10 +113,22 @@ func unmarshalMMC(m marshalledMMC) (mmc, error) {
 		mmc = &mapper003{}
 	case 4:
 		mmc = &mapper004{}
+	case 5:
+		mmc = &mapper005{}
 	case 7:
 		mmc = &mapper007{}
+	case 19:
+		mmc = &mapper019{}
+	case 20:
+		mmc = &mapper020{}
+	case 24, 26:
+		mmc = &mapper024{}
 	case 31:
 		mmc = &mapper031{}
+	case 69:
+		mmc = &mapper069{}
+	case 85:
+		mmc = &mapper085{}
 	default:
 		return nil, fmt.Errorf("state contained unknown mapper number %v", m.Number)
 	}
@@ -121,6 +179,11 @@ type mapper000 struct {
 func (m *mapper000) Init(mem *mem)          {}
 func (m *mapper000) RunCycle(emu *emuState) {}
 func (m *mapper000) Marshal() marshalledMMC { return marshalMMC(0, m) }
+func (m *mapper000) ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte {
+	return m.ReadVRAM(mem, addr)
+}
+func (m *mapper000) ObservePPUAddr(emu *emuState, addr uint16) {}
+func (m *mapper000) SoundChips() []soundChip                   { return nil }
 
 func (m *mapper000) Read(mem *mem, addr uint16) byte {
 	if addr >= 0x6000 && addr < 0x8000 {
@@ -222,6 +285,11 @@ func (m *mapper001) Init(mem *mem) {
 }
 func (m *mapper001) RunCycle(emu *emuState) {}
 func (m *mapper001) Marshal() marshalledMMC { return marshalMMC(1, m) }
+func (m *mapper001) ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte {
+	return m.ReadVRAM(mem, addr)
+}
+func (m *mapper001) ObservePPUAddr(emu *emuState, addr uint16) {}
+func (m *mapper001) SoundChips() []soundChip                   { return nil }
 
 func (m *mapper001) Read(mem *mem, addr uint16) byte {
 	if addr >= 0x6000 && addr < 0x8000 {
@@ -430,6 +498,11 @@ type mapper002 struct {
 func (m *mapper002) Init(mem *mem)          {}
 func (m *mapper002) RunCycle(emu *emuState) {}
 func (m *mapper002) Marshal() marshalledMMC { return marshalMMC(2, m) }
+func (m *mapper002) ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte {
+	return m.ReadVRAM(mem, addr)
+}
+func (m *mapper002) ObservePPUAddr(emu *emuState, addr uint16) {}
+func (m *mapper002) SoundChips() []soundChip                   { return nil }
 
 func (m *mapper002) Read(mem *mem, addr uint16) byte {
 	if addr >= 0x6000 && addr < 0x8000 {
@@ -507,6 +580,11 @@ func (m *mapper003) Init(mem *mem) {}
 
 func (m *mapper003) RunCycle(emu *emuState) {}
 func (m *mapper003) Marshal() marshalledMMC { return marshalMMC(3, m) }
+func (m *mapper003) ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte {
+	return m.ReadVRAM(mem, addr)
+}
+func (m *mapper003) ObservePPUAddr(emu *emuState, addr uint16) {}
+func (m *mapper003) SoundChips() []soundChip                   { return nil }
 
 func (m *mapper003) Read(mem *mem, addr uint16) byte {
 	if addr >= 0x6000 && addr < 0x8000 {
@@ -595,35 +673,67 @@ type mapper004 struct {
 	ChrBank4Number int
 	ChrBank5Number int
 
-	IRQLastPPUCycles          int // NOTE: if accuracy demands, change this to track ppu.AddrReg bit 12
 	IRQCounter                byte
 	IRQCounterReloadValue     byte
 	IRQCounterReloadRequested bool
 	IRQRequested              bool
 	IRQEnabled                bool
+
+	// MMC3A (submapper 4) only fires the irq when the counter
+	// is decremented to or reloaded to zero, later revs fire
+	// whenever it is zero after a clock.
+	IRQUsesRevABehavior bool
+
+	A12WasHigh    bool
+	A12LastFellAt uint64 // in ppu cycles
 }
 
+// how long A12 must stay low before a rise clocks the
+// irq counter. Filters out the ups and downs of the bg
+// fetches when bg and sprites use the same table, etc.
+const mmc3A12LowCyclesForClock = 10
+
 func (m *mapper004) Init(mem *mem)          {}
 func (m *mapper004) Marshal() marshalledMMC { return marshalMMC(4, m) }
+func (m *mapper004) ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte {
+	return m.ReadVRAM(mem, addr)
+}
 
-func (m *mapper004) RunCycle(emu *emuState) {
-	endOfScanline := 260
-	isRendering := emu.PPU.ShowBG && emu.PPU.LineY >= -1 && emu.PPU.LineY < 240
-	if isRendering && m.IRQLastPPUCycles < endOfScanline && emu.PPU.PPUCyclesSinceYInc >= endOfScanline {
-		if m.IRQCounterReloadRequested {
-			m.IRQCounterReloadRequested = false
-			m.IRQCounter = m.IRQCounterReloadValue
+func (m *mapper004) ObservePPUAddr(emu *emuState, addr uint16) {
+	a12IsHigh := addr&0x1000 == 0x1000
+	if a12IsHigh && !m.A12WasHigh {
+		if emu.PPU.PPUCycles-m.A12LastFellAt >= mmc3A12LowCyclesForClock {
+			m.clockIRQCounter()
 		}
-		if m.IRQCounter == 0 {
-			if m.IRQEnabled {
-				emu.CPU.IRQ = true
-			}
-			m.IRQCounter = m.IRQCounterReloadValue
-		} else {
-			m.IRQCounter--
+	} else if !a12IsHigh && m.A12WasHigh {
+		m.A12LastFellAt = emu.PPU.PPUCycles
+	}
+	m.A12WasHigh = a12IsHigh
+}
+
+func (m *mapper004) SoundChips() []soundChip { return nil }
+
+func (m *mapper004) clockIRQCounter() {
+	lastCounter := m.IRQCounter
+	reloaded := m.IRQCounterReloadRequested
+	if m.IRQCounter == 0 || m.IRQCounterReloadRequested {
+		m.IRQCounter = m.IRQCounterReloadValue
+	} else {
+		m.IRQCounter--
+	}
+	m.IRQCounterReloadRequested = false
+
+	if m.IRQCounter == 0 && m.IRQEnabled {
+		if !m.IRQUsesRevABehavior || lastCounter > 0 || reloaded {
+			m.IRQRequested = true
 		}
 	}
-	m.IRQLastPPUCycles = emu.PPU.PPUCyclesSinceYInc
+}
+
+func (m *mapper004) RunCycle(emu *emuState) {
+	if m.IRQRequested {
+		emu.CPU.IRQ = true // level triggered, held until ack'd
+	}
 }
 
 func (m *mapper004) Read(mem *mem, addr uint16) byte {
@@ -887,6 +997,11 @@ func (m *mapper007) Init(mem *mem) {
 
 func (m *mapper007) RunCycle(emu *emuState) {}
 func (m *mapper007) Marshal() marshalledMMC { return marshalMMC(7, m) }
+func (m *mapper007) ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte {
+	return m.ReadVRAM(mem, addr)
+}
+func (m *mapper007) ObservePPUAddr(emu *emuState, addr uint16) {}
+func (m *mapper007) SoundChips() []soundChip                   { return nil }
 
 func (m *mapper007) Read(mem *mem, addr uint16) byte {
 	if addr >= 0x6000 && addr < 0x8000 {
@@ -966,6 +1081,11 @@ func (m *mapper031) Init(mem *mem) {
 
 func (m *mapper031) RunCycle(emu *emuState) {}
 func (m *mapper031) Marshal() marshalledMMC { return marshalMMC(31, m) }
+func (m *mapper031) ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte {
+	return m.ReadVRAM(mem, addr)
+}
+func (m *mapper031) ObservePPUAddr(emu *emuState, addr uint16) {}
+func (m *mapper031) SoundChips() []soundChip                   { return nil }
 
 func (m *mapper031) Read(mem *mem, addr uint16) byte {
 	if addr >= 0x6000 && addr < 0x8000 {
@@ -0,0 +1,518 @@
+package famigo
+
+import "fmt"
+
+type mapper005 struct {
+	IsChrRAM bool
+
+	PrgBankMode byte
+	ChrBankMode byte
+
+	PrgRAMProtect1 byte
+	PrgRAMProtect2 byte
+
+	ExRAMMode        byte
+	ExRAM            [1024]byte
+	NametableMapping byte
+	FillTile         byte
+	FillAttr         byte
+
+	// $5113-$5117, bit 7 selects ROM for all but the first
+	PrgBanks [5]byte
+
+	// $5120-$512b, upper bits from $5130 already applied
+	ChrBanks          [12]int
+	ChrUpperBits      byte
+	LastChrWriteWasBG bool
+
+	SplitMode   byte
+	SplitScroll byte
+	SplitBank   byte
+
+	IRQScanlineCompare byte
+	IRQEnabled         bool
+	IRQPending         bool
+	InFrame            bool
+	ScanlineCounter    byte
+	LastLineY          int
+
+	MultiplierA byte
+	MultiplierB byte
+
+	UseBigSprites bool
+
+	Audio mmc5Audio
+
+	// state carried between the fetches of a single bg tile
+	ExtAttrByte  byte
+	TileIsSplit  bool
+	SplitTileRow int
+}
+
+const (
+	mmc5ExRAMNametable     = 0
+	mmc5ExRAMExtAttributes = 1
+	mmc5ExRAMReadWrite     = 2
+	mmc5ExRAMReadOnly      = 3
+)
+
+func (m *mapper005) Init(mem *mem) {
+	m.PrgBankMode = 3
+	m.PrgBanks[4] = 0xff
+}
+
+func (m *mapper005) Marshal() marshalledMMC { return marshalMMC(5, m) }
+
+func (m *mapper005) ObservePPUAddr(emu *emuState, addr uint16) {}
+func (m *mapper005) SoundChips() []soundChip                   { return []soundChip{&m.Audio} }
+
+func (m *mapper005) RunCycle(emu *emuState) {
+	ppu := &emu.PPU
+	m.UseBigSprites = ppu.UseBigSprites
+
+	isRendering := ppu.ShowBG || ppu.ShowSprites
+	if !isRendering || ppu.LineY < 0 || ppu.LineY >= 240 {
+		m.InFrame = false
+	} else if ppu.LineY != m.LastLineY {
+		if !m.InFrame {
+			m.InFrame = true
+			m.ScanlineCounter = 0
+			m.IRQPending = false
+		} else {
+			m.ScanlineCounter++
+			if m.ScanlineCounter == m.IRQScanlineCompare {
+				m.IRQPending = true
+			}
+		}
+	}
+	m.LastLineY = ppu.LineY
+
+	if m.IRQPending && m.IRQEnabled {
+		emu.CPU.IRQ = true
+	}
+	if m.Audio.PCMIRQRequested && m.Audio.PCMIRQEnabled {
+		emu.CPU.IRQ = true // level triggered, held until ack'd
+	}
+}
+
+func (m *mapper005) getPrgAddr(mem *mem, addr uint16) (isROM bool, realAddr int) {
+	if addr < 0x8000 {
+		realAddr = int(m.PrgBanks[0]&0x07)*8*1024 + int(addr-0x6000)
+		return false, realAddr & (len(mem.PrgRAM) - 1)
+	}
+
+	var reg byte
+	var bankSize int
+	switch m.PrgBankMode {
+	case 0:
+		reg, bankSize = m.PrgBanks[4]|0x80, 32*1024
+	case 1:
+		if addr < 0xc000 {
+			reg, bankSize = m.PrgBanks[2], 16*1024
+		} else {
+			reg, bankSize = m.PrgBanks[4]|0x80, 16*1024
+		}
+	case 2:
+		if addr < 0xc000 {
+			reg, bankSize = m.PrgBanks[2], 16*1024
+		} else if addr < 0xe000 {
+			reg, bankSize = m.PrgBanks[3], 8*1024
+		} else {
+			reg, bankSize = m.PrgBanks[4]|0x80, 8*1024
+		}
+	case 3:
+		slot := int(addr-0x8000) / (8 * 1024)
+		reg, bankSize = m.PrgBanks[1+slot], 8*1024
+		if slot == 3 {
+			reg |= 0x80
+		}
+	}
+
+	// bank regs are always in 8k units, low bits ignored for bigger banks
+	bank := int(reg&0x7f) &^ (bankSize/(8*1024) - 1)
+	realAddr = bank*8*1024 + int(addr)&(bankSize-1)
+
+	if reg&0x80 == 0 {
+		return false, realAddr & (len(mem.PrgRAM) - 1)
+	}
+	return true, realAddr & (len(mem.prgROM) - 1)
+}
+
+func (m *mapper005) prgRAMWritable() bool {
+	return m.PrgRAMProtect1&0x03 == 0x02 && m.PrgRAMProtect2&0x03 == 0x01
+}
+
+func (m *mapper005) Read(mem *mem, addr uint16) byte {
+	switch {
+	case addr >= 0x5000 && addr <= 0x5015:
+		return m.Audio.readReg(addr)
+	case addr == 0x5204:
+		val := boolBit(m.IRQPending, 7) | boolBit(m.InFrame, 6)
+		m.IRQPending = false
+		return val
+	case addr == 0x5205:
+		return byte(uint16(m.MultiplierA) * uint16(m.MultiplierB))
+	case addr == 0x5206:
+		return byte((uint16(m.MultiplierA) * uint16(m.MultiplierB)) >> 8)
+	case addr >= 0x5c00 && addr < 0x6000:
+		if m.ExRAMMode == mmc5ExRAMReadWrite || m.ExRAMMode == mmc5ExRAMReadOnly {
+			return m.ExRAM[addr-0x5c00]
+		}
+	case addr >= 0x6000:
+		var val byte
+		if isROM, realAddr := m.getPrgAddr(mem, addr); isROM {
+			val = mem.prgROM[realAddr]
+		} else {
+			val = mem.PrgRAM[realAddr]
+		}
+		if addr >= 0x8000 && addr < 0xc000 {
+			m.Audio.observePrgRead(val)
+		}
+		return val
+	}
+	return 0xff
+}
+
+func (m *mapper005) Write(mem *mem, addr uint16, val byte) {
+	switch {
+	case addr >= 0x5000 && addr <= 0x5015:
+		m.Audio.writeReg(addr, val)
+	case addr == 0x5100:
+		m.PrgBankMode = val & 0x03
+	case addr == 0x5101:
+		m.ChrBankMode = val & 0x03
+	case addr == 0x5102:
+		m.PrgRAMProtect1 = val
+	case addr == 0x5103:
+		m.PrgRAMProtect2 = val
+	case addr == 0x5104:
+		m.ExRAMMode = val & 0x03
+	case addr == 0x5105:
+		m.NametableMapping = val
+	case addr == 0x5106:
+		m.FillTile = val
+	case addr == 0x5107:
+		m.FillAttr = val & 0x03
+	case addr >= 0x5113 && addr <= 0x5117:
+		m.PrgBanks[addr-0x5113] = val
+	case addr >= 0x5120 && addr <= 0x512b:
+		m.ChrBanks[addr-0x5120] = int(m.ChrUpperBits)<<8 | int(val)
+		m.LastChrWriteWasBG = addr >= 0x5128
+	case addr == 0x5130:
+		m.ChrUpperBits = val & 0x03
+	case addr == 0x5200:
+		m.SplitMode = val
+	case addr == 0x5201:
+		m.SplitScroll = val
+	case addr == 0x5202:
+		m.SplitBank = val
+	case addr == 0x5203:
+		m.IRQScanlineCompare = val
+	case addr == 0x5204:
+		m.IRQEnabled = val&0x80 == 0x80
+	case addr == 0x5205:
+		m.MultiplierA = val
+	case addr == 0x5206:
+		m.MultiplierB = val
+	case addr >= 0x5c00 && addr < 0x6000:
+		switch m.ExRAMMode {
+		case mmc5ExRAMNametable, mmc5ExRAMExtAttributes:
+			if !m.InFrame {
+				val = 0
+			}
+			m.ExRAM[addr-0x5c00] = val
+		case mmc5ExRAMReadWrite:
+			m.ExRAM[addr-0x5c00] = val
+		}
+	case addr >= 0x6000 && addr < 0xe000:
+		isROM, realAddr := m.getPrgAddr(mem, addr)
+		if !isROM && m.prgRAMWritable() {
+			mem.PrgRAM[realAddr] = val
+		}
+	}
+}
+
+func (m *mapper005) getChrAddr(mem *mem, addr uint16, useBGBanks bool) int {
+	var bank, bankSize int
+	switch m.ChrBankMode {
+	case 0:
+		bankSize = 8 * 1024
+		if useBGBanks {
+			bank = m.ChrBanks[11]
+		} else {
+			bank = m.ChrBanks[7]
+		}
+	case 1:
+		bankSize = 4 * 1024
+		if useBGBanks {
+			bank = m.ChrBanks[11]
+		} else {
+			bank = m.ChrBanks[3+4*int(addr>>12)]
+		}
+	case 2:
+		bankSize = 2 * 1024
+		slot := int(addr >> 11)
+		if useBGBanks {
+			bank = m.ChrBanks[9+2*(slot&0x01)]
+		} else {
+			bank = m.ChrBanks[1+2*slot]
+		}
+	case 3:
+		bankSize = 1024
+		slot := int(addr >> 10)
+		if useBGBanks {
+			bank = m.ChrBanks[8+(slot&0x03)]
+		} else {
+			bank = m.ChrBanks[slot]
+		}
+	}
+	realAddr := bank*bankSize + int(addr)&(bankSize-1)
+	return realAddr & (len(mem.chrROM) - 1)
+}
+
+// 8x8 sprites always use the sprite banks. Otherwise
+// the cpu sees whichever set was written last.
+func (m *mapper005) cpuUsesBGBanks() bool {
+	return m.UseBigSprites && m.LastChrWriteWasBG
+}
+
+func (m *mapper005) readNametable(mem *mem, addr uint16) byte {
+	offset := addr & 0x03ff
+	switch m.getNametableSource(addr) {
+	case 0:
+		return mem.InternalVRAM[offset]
+	case 1:
+		return mem.InternalVRAM[0x400+offset]
+	case 2:
+		if m.ExRAMMode == mmc5ExRAMNametable || m.ExRAMMode == mmc5ExRAMExtAttributes {
+			return m.ExRAM[offset]
+		}
+		return 0
+	default: // fill mode
+		if offset >= 0x3c0 {
+			return m.FillAttr * 0x55
+		}
+		return m.FillTile
+	}
+}
+
+func (m *mapper005) writeNametable(mem *mem, addr uint16, val byte) {
+	offset := addr & 0x03ff
+	switch m.getNametableSource(addr) {
+	case 0:
+		mem.InternalVRAM[offset] = val
+	case 1:
+		mem.InternalVRAM[0x400+offset] = val
+	case 2:
+		if m.ExRAMMode == mmc5ExRAMNametable || m.ExRAMMode == mmc5ExRAMExtAttributes {
+			m.ExRAM[offset] = val
+		}
+	default:
+		// fill mode: nop
+	}
+}
+
+func (m *mapper005) getNametableSource(addr uint16) byte {
+	slot := ((addr - 0x2000) >> 10) & 0x03
+	return (m.NametableMapping >> (slot * 2)) & 0x03
+}
+
+func (m *mapper005) ReadVRAM(mem *mem, addr uint16) byte {
+	var val byte
+	switch {
+	case addr < 0x2000:
+		val = mem.chrROM[m.getChrAddr(mem, addr, m.cpuUsesBGBanks())]
+	case addr >= 0x2000 && addr < 0x3000:
+		val = m.readNametable(mem, addr)
+	default:
+		emuErr(fmt.Sprintf("mapper005: unimplemented vram access: read(%04x)", addr))
+	}
+	return val
+}
+
+func (m *mapper005) WriteVRAM(mem *mem, addr uint16, val byte) {
+	switch {
+	case addr < 0x2000:
+		if m.IsChrRAM {
+			mem.chrROM[m.getChrAddr(mem, addr, m.cpuUsesBGBanks())] = val
+		}
+	case addr >= 0x2000 && addr < 0x3000:
+		m.writeNametable(mem, addr, val)
+	default:
+		emuErr(fmt.Sprintf("mapper005: unimplemented vram access: write(%04x, %02x)", addr, val))
+	}
+}
+
+func (m *mapper005) inSplitRegion(tileX int) bool {
+	if m.SplitMode&0x80 == 0 || !m.InFrame {
+		return false
+	}
+	if m.ExRAMMode != mmc5ExRAMNametable && m.ExRAMMode != mmc5ExRAMExtAttributes {
+		return false
+	}
+	threshold := int(m.SplitMode & 0x1f)
+	if m.SplitMode&0x40 == 0 {
+		return tileX < threshold // left side
+	}
+	return tileX >= threshold // right side
+}
+
+func (m *mapper005) getSplitY() int {
+	return (int(m.SplitScroll) + int(m.ScanlineCounter)) % 240
+}
+
+func (m *mapper005) ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte {
+	switch fetch.Kind {
+	case bgNametableFetch:
+		m.TileIsSplit = m.inSplitRegion(fetch.TileX)
+		if m.TileIsSplit {
+			m.SplitTileRow = m.getSplitY() / 8
+			return m.ExRAM[m.SplitTileRow*32+fetch.TileX&0x1f]
+		}
+		if m.ExRAMMode == mmc5ExRAMExtAttributes {
+			m.ExtAttrByte = m.ExRAM[addr&0x03ff]
+		}
+		return m.readNametable(mem, addr)
+
+	case bgAttributeFetch:
+		// return the palette in all four quadrants, as the
+		// ppu's idea of which quadrant it's in may be wrong
+		if m.TileIsSplit {
+			tileX := fetch.TileX & 0x1f
+			attr := m.ExRAM[0x3c0+(m.SplitTileRow/4)*8+tileX/4]
+			shift := uint((m.SplitTileRow&0x02)<<1 | tileX&0x02)
+			return ((attr >> shift) & 0x03) * 0x55
+		}
+		if m.ExRAMMode == mmc5ExRAMExtAttributes {
+			return (m.ExtAttrByte >> 6) * 0x55
+		}
+		return m.readNametable(mem, addr)
+
+	case bgPatternFetch:
+		if m.TileIsSplit {
+			fineY := uint16(m.getSplitY() & 0x07)
+			realAddr := int(m.SplitBank)*4*1024 + int((addr&0x0ff8)|fineY)
+			return mem.chrROM[realAddr&(len(mem.chrROM)-1)]
+		}
+		if m.ExRAMMode == mmc5ExRAMExtAttributes {
+			bank := int(m.ChrUpperBits)<<6 | int(m.ExtAttrByte&0x3f)
+			realAddr := bank*4*1024 + int(addr&0x0fff)
+			return mem.chrROM[realAddr&(len(mem.chrROM)-1)]
+		}
+		return mem.chrROM[m.getChrAddr(mem, addr, m.UseBigSprites)]
+
+	case spritePatternFetch:
+		return mem.chrROM[m.getChrAddr(mem, addr, false)]
+	}
+	return m.ReadVRAM(mem, addr)
+}
+
+// mmc5Audio is the MMC5's sound: two pulses that work like the
+// apu's (minus the sweep units, and with their own 240hz frame
+// counter), and an 8-bit pcm channel. The pcm can be written
+// directly, or set from reads of $8000-$bfff.
+type mmc5Audio struct {
+	Pulse1 sound
+	Pulse2 sound
+
+	FrameCounter int
+
+	PCMValue        byte
+	PCMReadMode     bool
+	PCMIRQEnabled   bool
+	PCMIRQRequested bool
+}
+
+const mmc5CyclesPerFrameStep = 7457 // ~240hz
+
+// a full swing pcm comes out about as loud as a full swing dmc
+const mmc5PCMLevelScale = 159.79 / (22638.0/127 + 100) / 255
+
+func (a *mmc5Audio) channelNames() []string {
+	return []string{"MMC5 Pulse 1", "MMC5 Pulse 2", "MMC5 PCM"}
+}
+
+func (a *mmc5Audio) readReg(addr uint16) byte {
+	switch addr {
+	case 0x5010:
+		val := boolBit(a.PCMIRQRequested, 7) | boolBit(a.PCMReadMode, 0)
+		a.PCMIRQRequested = false
+		return val
+	case 0x5015:
+		return boolBit(a.Pulse2.LengthCounter > 0, 1) | boolBit(a.Pulse1.LengthCounter > 0, 0)
+	}
+	return 0xff
+}
+
+func (a *mmc5Audio) writeReg(addr uint16, val byte) {
+	switch addr {
+	case 0x5000:
+		a.Pulse1.writeVolDutyReg(val)
+	case 0x5002:
+		a.Pulse1.writePeriodLowReg(val)
+	case 0x5003:
+		a.Pulse1.writePeriodHighTimerReg(val)
+	case 0x5004:
+		a.Pulse2.writeVolDutyReg(val)
+	case 0x5006:
+		a.Pulse2.writePeriodLowReg(val)
+	case 0x5007:
+		a.Pulse2.writePeriodHighTimerReg(val)
+	case 0x5010:
+		a.PCMReadMode = val&0x01 == 0x01
+		a.PCMIRQEnabled = val&0x80 == 0x80
+	case 0x5011:
+		// zero can't be written, only read (to trigger the irq)
+		if !a.PCMReadMode && val != 0 {
+			a.PCMValue = val
+		}
+	case 0x5015:
+		a.Pulse1.setChannelOn(val&0x01 == 0x01)
+		a.Pulse2.setChannelOn(val&0x02 == 0x02)
+	}
+}
+
+func (a *mmc5Audio) observePrgRead(val byte) {
+	if !a.PCMReadMode {
+		return
+	}
+	if val == 0 {
+		a.PCMIRQRequested = true
+	} else {
+		a.PCMValue = val
+	}
+}
+
+func (a *mmc5Audio) runCycle() {
+	a.Pulse1.runFreqCycle(nil)
+	a.Pulse2.runFreqCycle(nil)
+
+	a.FrameCounter++
+	if a.FrameCounter >= mmc5CyclesPerFrameStep {
+		a.FrameCounter = 0
+		a.Pulse1.runEnvCycle()
+		a.Pulse2.runEnvCycle()
+		a.Pulse1.runLengthCycle()
+		a.Pulse2.runLengthCycle()
+	}
+}
+
+// getPulseLevel is sound.getSample, minus the sweep unit's muting
+func (a *mmc5Audio) getPulseLevel(p *sound) byte {
+	if p.On && p.LengthCounter > 0 && p.inDutyCycle() {
+		return p.getCurrentVolume()
+	}
+	return 0
+}
+
+func (a *mmc5Audio) getOutputs(outputs []float64) {
+	outputs[0] = float64(a.getPulseLevel(&a.Pulse1)) * apuPulseStep
+	outputs[1] = float64(a.getPulseLevel(&a.Pulse2)) * apuPulseStep
+	outputs[2] = float64(a.PCMValue) * mmc5PCMLevelScale
+}
+
+func (a *mmc5Audio) getNotes(notes []channelNote) {
+	notes[0] = a.Pulse1.getNote()
+	notes[1] = a.Pulse2.getNote()
+	notes[2] = channelNote{} // pcm has no pitch
+}
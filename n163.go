@@ -0,0 +1,274 @@
+package famigo
+
+import "fmt"
+
+// mapper019 is the Namco 163 (and 129). Besides the N163 sound,
+// it can put CIRAM in the pattern tables or chr rom in the
+// nametables, and has a cpu cycle irq counter.
+type mapper019 struct {
+	IsChrRAM bool
+
+	PrgBanks [3]int // $8000, $a000, $c000, in 8k units
+
+	// bank values of $e0 and up pick a CIRAM page instead of rom
+	ChrBanks       [8]byte // pattern tables, 1k each
+	NametableBanks [4]byte
+
+	// when set, the pattern tables always use rom, regardless of bank value
+	LowChrIsROMOnly  bool
+	HighChrIsROMOnly bool
+
+	IRQCounter   uint16 // 15 bits
+	IRQEnabled   bool
+	IRQRequested bool
+
+	N163 n163Audio
+}
+
+func (m *mapper019) Init(mem *mem)          {}
+func (m *mapper019) Marshal() marshalledMMC { return marshalMMC(19, m) }
+func (m *mapper019) ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte {
+	return m.ReadVRAM(mem, addr)
+}
+func (m *mapper019) ObservePPUAddr(emu *emuState, addr uint16) {}
+func (m *mapper019) SoundChips() []soundChip                   { return []soundChip{&m.N163} }
+
+func (m *mapper019) RunCycle(emu *emuState) {
+	if m.IRQEnabled && m.IRQCounter < 0x7fff {
+		m.IRQCounter++
+		if m.IRQCounter == 0x7fff {
+			m.IRQRequested = true
+		}
+	}
+	if m.IRQRequested {
+		emu.CPU.IRQ = true // level triggered, held until ack'd
+	}
+}
+
+func (m *mapper019) Read(mem *mem, addr uint16) byte {
+	switch {
+	case addr >= 0x4800 && addr < 0x5000:
+		return m.N163.readData()
+	case addr >= 0x5000 && addr < 0x5800:
+		return byte(m.IRQCounter)
+	case addr >= 0x5800 && addr < 0x6000:
+		val := byte(m.IRQCounter >> 8)
+		if m.IRQEnabled {
+			val |= 0x80
+		}
+		return val
+	case addr >= 0x6000 && addr < 0x8000:
+		// write protect bits in $f800, ignored for easier compat
+		return mem.PrgRAM[int(addr-0x6000)&(len(mem.PrgRAM)-1)]
+	case addr >= 0x8000 && addr < 0xe000:
+		slot := int(addr-0x8000) / (8 * 1024)
+		return mem.prgROM[m.PrgBanks[slot]*8*1024+int(addr&0x1fff)]
+	case addr >= 0xe000:
+		offset := len(mem.prgROM) - 8*1024 // last bank
+		return mem.prgROM[offset+int(addr-0xe000)]
+	}
+	return 0xff
+}
+
+func (m *mapper019) Write(mem *mem, addr uint16, val byte) {
+	switch {
+	case addr >= 0x4800 && addr < 0x5000:
+		m.N163.writeData(val)
+	case addr >= 0x5000 && addr < 0x5800:
+		m.IRQCounter = m.IRQCounter&0x7f00 | uint16(val)
+		m.IRQRequested = false
+	case addr >= 0x5800 && addr < 0x6000:
+		m.IRQCounter = m.IRQCounter&0x00ff | uint16(val&0x7f)<<8
+		m.IRQEnabled = val&0x80 == 0x80
+		m.IRQRequested = false
+	case addr >= 0x6000 && addr < 0x8000:
+		mem.PrgRAM[int(addr-0x6000)&(len(mem.PrgRAM)-1)] = val
+	case addr >= 0x8000 && addr < 0xc000:
+		m.ChrBanks[(addr-0x8000)>>11] = val
+	case addr >= 0xc000 && addr < 0xe000:
+		m.NametableBanks[(addr-0xc000)>>11] = val
+	case addr >= 0xe000 && addr < 0xe800:
+		m.PrgBanks[0] = wrapBank(int(val&0x3f), mem.prgROM, 8*1024)
+		m.N163.Disabled = val&0x40 == 0x40
+	case addr >= 0xe800 && addr < 0xf000:
+		m.PrgBanks[1] = wrapBank(int(val&0x3f), mem.prgROM, 8*1024)
+		m.LowChrIsROMOnly = val&0x40 == 0x40
+		m.HighChrIsROMOnly = val&0x80 == 0x80
+	case addr >= 0xf000 && addr < 0xf800:
+		m.PrgBanks[2] = wrapBank(int(val&0x3f), mem.prgROM, 8*1024)
+	case addr >= 0xf800:
+		m.N163.writeAddr(val)
+	}
+}
+
+// getVRAMPtr works out where a ppu addr lands, which (thanks to the
+// bank regs) can be chr rom or CIRAM for both patterns and nametables
+func (m *mapper019) getVRAMPtr(mem *mem, addr uint16) (ptr *byte, isROM bool) {
+	var bank byte
+	useCIRAM := false
+	if addr < 0x2000 {
+		slot := addr >> 10
+		bank = m.ChrBanks[slot]
+		romOnly := m.LowChrIsROMOnly
+		if slot >= 4 {
+			romOnly = m.HighChrIsROMOnly
+		}
+		useCIRAM = bank >= 0xe0 && !romOnly
+	} else {
+		bank = m.NametableBanks[(addr>>10)&0x03]
+		useCIRAM = bank >= 0xe0
+	}
+	if useCIRAM {
+		return &mem.InternalVRAM[int(bank&0x01)*1024+int(addr&0x03ff)], false
+	}
+	bankNum := wrapBank(int(bank), mem.chrROM, 1024)
+	return &mem.chrROM[bankNum*1024+int(addr&0x03ff)], !m.IsChrRAM
+}
+
+func (m *mapper019) ReadVRAM(mem *mem, addr uint16) byte {
+	if addr >= 0x3000 {
+		emuErr(fmt.Sprintf("mapper019: unimplemented vram access: read(%04x)", addr))
+	}
+	ptr, _ := m.getVRAMPtr(mem, addr)
+	return *ptr
+}
+
+func (m *mapper019) WriteVRAM(mem *mem, addr uint16, val byte) {
+	if addr >= 0x3000 {
+		emuErr(fmt.Sprintf("mapper019: unimplemented vram access: write(%04x, %02x)", addr, val))
+	}
+	if ptr, isROM := m.getVRAMPtr(mem, addr); !isROM {
+		*ptr = val
+	}
+}
+
+// n163Audio is the Namco 163's wavetable sound. Up to 8 channels
+// read 4-bit samples out of a shared 128 byte RAM, which also holds
+// the channel registers. Only one channel is updated (and output)
+// at a time, so more channels means each is quieter.
+type n163Audio struct {
+	RAM           [128]byte
+	Addr          byte
+	AutoIncrement bool
+	Disabled      bool // mapper 19 can switch the sound off
+
+	CycleCount     int
+	CurrentChannel int
+	Levels         [8]int // last sample * volume, per channel
+}
+
+// a full volume, full swing wave on one channel
+// comes out a little under twice as loud as an apu pulse
+const n163LevelScale = apuPulseStep / 8
+
+func (n *n163Audio) channelNames() []string {
+	return []string{
+		"N163 1", "N163 2", "N163 3", "N163 4",
+		"N163 5", "N163 6", "N163 7", "N163 8",
+	}
+}
+
+func (n *n163Audio) writeAddr(val byte) {
+	n.Addr = val & 0x7f
+	n.AutoIncrement = val&0x80 == 0x80
+}
+
+func (n *n163Audio) readData() byte {
+	val := n.RAM[n.Addr]
+	n.incAddr()
+	return val
+}
+
+func (n *n163Audio) writeData(val byte) {
+	n.RAM[n.Addr] = val
+	n.incAddr()
+}
+
+func (n *n163Audio) incAddr() {
+	if n.AutoIncrement {
+		n.Addr = (n.Addr + 1) & 0x7f
+	}
+}
+
+// the number of channels is in the last channel's regs
+func (n *n163Audio) numChannels() int {
+	return int((n.RAM[0x7f]>>4)&0x07) + 1
+}
+
+// channels are updated from the last one back, one every 15
+// cycles, and only the last numChannels are enabled
+func (n *n163Audio) runCycle() {
+	if n.Disabled {
+		return
+	}
+	n.CycleCount++
+	if n.CycleCount < 15 {
+		return
+	}
+	n.CycleCount = 0
+
+	numChannels := n.numChannels()
+	if n.CurrentChannel < 8-numChannels {
+		n.CurrentChannel = 7
+	}
+	n.updateChannel(n.CurrentChannel)
+	n.CurrentChannel--
+	if n.CurrentChannel < 8-numChannels {
+		n.CurrentChannel = 7
+	}
+}
+
+func (n *n163Audio) updateChannel(c int) {
+	regs := n.RAM[0x40+c*8 : 0x40+c*8+8]
+
+	freq := uint32(regs[4]&0x03)<<16 | uint32(regs[2])<<8 | uint32(regs[0])
+	phase := uint32(regs[5])<<16 | uint32(regs[3])<<8 | uint32(regs[1])
+	length := 256 - uint32(regs[4]&0xfc)
+
+	phase = (phase + freq) % (length << 16)
+	regs[5], regs[3], regs[1] = byte(phase>>16), byte(phase>>8), byte(phase)
+
+	sampleAddr := (uint32(regs[6]) + phase>>16) & 0xff
+	sample := n.RAM[sampleAddr>>1]
+	if sampleAddr&0x01 == 0 {
+		sample &= 0x0f
+	} else {
+		sample >>= 4
+	}
+	volume := int(regs[7] & 0x0f)
+	n.Levels[c] = (int(sample) - 8) * volume
+}
+
+// outputs are numbered by play order, so "N163 1" is the
+// channel that's still there when only one is enabled
+func (n *n163Audio) getNotes(notes []channelNote) {
+	numChannels := n.numChannels()
+	for i := range notes[:8] {
+		notes[i] = channelNote{}
+		if i >= numChannels || n.Disabled {
+			continue
+		}
+		regs := n.RAM[0x40+(7-i)*8 : 0x40+(7-i)*8+8]
+		freq := uint32(regs[4]&0x03)<<16 | uint32(regs[2])<<8 | uint32(regs[0])
+		length := 256 - uint32(regs[4]&0xfc)
+		volume := regs[7] & 0x0f
+		if freq == 0 || volume == 0 {
+			continue
+		}
+		// each channel's phase is stepped by freq once every
+		// 15*numChannels cycles, and wraps at length<<16
+		period := float64(15*numChannels) * float64(length<<16) / float64(freq)
+		notes[i] = channelNote{Period: period, Volume: float64(volume) / 15}
+	}
+}
+
+func (n *n163Audio) getOutputs(outputs []float64) {
+	numChannels := n.numChannels()
+	for i := range n.Levels {
+		if i >= numChannels || n.Disabled {
+			outputs[i] = 0
+		} else {
+			outputs[i] = float64(n.Levels[7-i]) * n163LevelScale / float64(numChannels)
+		}
+	}
+}
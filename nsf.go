@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/theinternetftw/cpugo/virt6502"
@@ -15,14 +16,26 @@ type nsfPlayer struct {
 	HdrExtended        *parsedNsfe
 	PlayCallInterval   int
 	LastPlayCall       uint64
+	InitRunning        bool // for nsf2 non-returning inits
+	PlayInterrupted    bool // whether PLAY was called on top of INIT
 	CurrentSong        byte
-	CurrentSongLen     time.Duration
+	CurrentSongLen     time.Duration // includes the fade, zero if unknown
 	CurrentSongFadeLen time.Duration
-	CurrentSongStart   time.Time
+	CurrentSongStart   uint64 // in cycles, like all nsf timing
+	LastScreenUpdate   uint64
 	TvStdBit           byte
 	Paused             bool
-	PauseStartTime     time.Time
+	SelectedChannel    int
+	PlaylistPos        int  // index into playlist()
+	PlaySfx            bool // whether psfx tracks are in the playlist
+	ShowingInfo        bool
+	InfoScroll         int
+	AutoEnd            bool
+	SilenceLen         time.Duration
+	LoopDetector       nsfLoopDetector
 	TextDisplay        textDisplay
+	Scope              nsfScope
+	PianoRoll          [256 * nsfRollH * 4]byte
 	DbgScreen          [256 * 240 * 4]byte
 	DbgFlipRequested   bool
 
@@ -57,7 +70,8 @@ type nsfHeader struct {
 	PlaySpeedPal   uint16
 	TvStdFlags     byte
 	SoundChipFlags byte
-	Reserved       [4]byte
+	Nsf2Flags      byte    // only used in version 2
+	Nsf2DataLen    [3]byte // 24-bit, zero means to the end of the file
 }
 
 type parsedNsfe struct {
@@ -70,6 +84,9 @@ type parsedNsfe struct {
 	tlbl tlblChunk
 	auth authChunk
 	text textChunk
+	psfx psfxChunk
+	rate rateChunk
+	regn regnChunk
 }
 
 type chunkHdr struct {
@@ -93,18 +110,35 @@ func (p *parsedNsfe) getNsfHeader() nsfHeader {
 		NumSongs:       p.info.NumSongs,
 		StartSong:      p.info.StartSong + 1,
 	}
-	if hdr.isNTSC() {
-		hdr.PlaySpeedNtsc = defaultSpeedNtsc
-	} else {
-		hdr.PlaySpeedPal = defaultSpeedPal
-	}
+	hdr.PlaySpeedNtsc = defaultSpeedNtsc
+	hdr.PlaySpeedPal = defaultSpeedPal
 	hdr.BankVals = p.bank.BankVals
 	copy(hdr.SongName[:], p.auth.GameTitle) // what it really is, anyway... or album
 	copy(hdr.ArtistName[:], p.auth.Artist)
 	copy(hdr.CopyrightName[:], p.auth.Copyright)
+	p.applyRateAndRegn(&hdr)
 	return hdr
 }
 
+// applyRateAndRegn overrides the header's play speeds
+// and tv standard with whatever RATE and regn give.
+func (p *parsedNsfe) applyRateAndRegn(hdr *nsfHeader) {
+	if p.rate.PlaySpeedNtsc != 0 {
+		hdr.PlaySpeedNtsc = p.rate.PlaySpeedNtsc
+	}
+	if p.rate.PlaySpeedPal != 0 {
+		hdr.PlaySpeedPal = p.rate.PlaySpeedPal
+	}
+	switch p.regn.Regions & (nsfeRegionNTSC | nsfeRegionPAL) {
+	case nsfeRegionNTSC:
+		hdr.TvStdFlags = 0x00
+	case nsfeRegionPAL:
+		hdr.TvStdFlags = 0x01
+	case nsfeRegionNTSC | nsfeRegionPAL:
+		hdr.TvStdFlags = 0x02
+	}
+}
+
 func readStructLE(structBytes []byte, iface interface{}) error {
 	return binary.Read(bytes.NewReader(structBytes), binary.LittleEndian, iface)
 }
@@ -120,34 +154,48 @@ func getNullStr(bytes []byte) string {
 
 func parseNsfe(nsfe []byte) (*parsedNsfe, error) {
 	parsed := parsedNsfe{}
-	nsfe = nsfe[4:] // skip magic
-	var sawInfo, sawData, sawNend bool
-	for len(nsfe) > 0 {
+	seen, err := parseNsfeChunks(nsfe[4:], &parsed, true) // skip magic
+	if err != nil {
+		return nil, err
+	}
+	for _, required := range []string{"INFO", "DATA", "NEND"} {
+		if !seen[required] {
+			return nil, fmt.Errorf("bad nsfe, missing required chunk %s", required)
+		}
+	}
+	parsed.fillDefaults()
+	return &parsed, nil
+}
+
+// parseNsfeChunks reads chunks into parsed, stopping at NEND. It
+// returns which chunks it saw. When strict, chunks that can't be
+// skipped (they start with a capital) but aren't known are errors.
+func parseNsfeChunks(nsfe []byte, parsed *parsedNsfe, strict bool) (map[string]bool, error) {
+	seen := map[string]bool{}
+	for len(nsfe) > 0 && !seen["NEND"] {
 		chunkHdr := chunkHdr{}
 		if err := readStructLE(nsfe, &chunkHdr); err != nil {
 			return nil, err
 		}
+		nsfe = nsfe[8:] // past hdr
 		if int(chunkHdr.ChunkLen) > len(nsfe) {
 			return nil, fmt.Errorf("bad nsfe chunk length %v", chunkHdr.ChunkLen)
 		}
-		nsfe = nsfe[8:] // past hdr
 		chunkName := string(chunkHdr.Fourcc[:])
+		seen[chunkName] = true
 		switch chunkName {
 		case "INFO":
-			sawInfo = true
 			if err := readStructLE(nsfe, &parsed.info); err != nil {
 				return nil, err
 			}
 		case "DATA":
-			sawData = true
 			parsed.data = nsfe[:chunkHdr.ChunkLen]
 		case "BANK":
 			for i := uint32(0); i < 8 && i < chunkHdr.ChunkLen; i++ {
 				parsed.bank.BankVals[i] = nsfe[i]
 			}
 		case "NEND":
-			sawNend = true
-			break
+			// ends the loop
 		case "time":
 			for i := uint32(0); i < chunkHdr.ChunkLen; i += 4 {
 				var songLen int32
@@ -173,6 +221,36 @@ func parseNsfe(nsfe []byte) (*parsedNsfe, error) {
 			parsed.auth.Copyright = getNullStr(authBytes)
 			authBytes = authBytes[len(parsed.auth.Copyright)+1:]
 			parsed.auth.Ripper = getNullStr(authBytes)
+		case "plst":
+			parsed.plst = &plstChunk{Playlist: append([]byte{}, nsfe[:chunkHdr.ChunkLen]...)}
+		case "psfx":
+			parsed.psfx.SfxTracks = append([]byte{}, nsfe[:chunkHdr.ChunkLen]...)
+		case "text":
+			textBytes := nsfe[:chunkHdr.ChunkLen]
+			if end := bytes.IndexByte(textBytes, 0); end >= 0 {
+				textBytes = textBytes[:end]
+			}
+			parsed.text.Text = string(textBytes)
+		case "RATE":
+			// any of these can be left off the end
+			speeds := []*uint16{&parsed.rate.PlaySpeedNtsc, &parsed.rate.PlaySpeedPal, &parsed.rate.PlaySpeedDendy}
+			for i := uint32(0); i+1 < chunkHdr.ChunkLen && int(i/2) < len(speeds); i += 2 {
+				*speeds[i/2] = binary.LittleEndian.Uint16(nsfe[i:])
+			}
+		case "regn":
+			if chunkHdr.ChunkLen > 0 {
+				parsed.regn.Regions = nsfe[0]
+			}
+			if chunkHdr.ChunkLen > 1 {
+				switch nsfe[1] {
+				case 0:
+					parsed.regn.Preferred = RegionNTSC
+				case 1:
+					parsed.regn.Preferred = RegionPAL
+				case 2:
+					parsed.regn.Preferred = RegionDendy
+				}
+			}
 		case "tlbl":
 			tlblBytes := nsfe[:chunkHdr.ChunkLen]
 			for len(tlblBytes) > 0 {
@@ -181,21 +259,18 @@ func parseNsfe(nsfe []byte) (*parsedNsfe, error) {
 				tlblBytes = tlblBytes[len(songName)+1:]
 			}
 		default:
-			if chunkName[0] >= 'A' && chunkName[0] <= 'Z' {
+			if strict && chunkName[0] >= 'A' && chunkName[0] <= 'Z' {
 				return nil, fmt.Errorf("unknown and required nsfe chunk %q", chunkName)
 			}
 		}
 		nsfe = nsfe[chunkHdr.ChunkLen:]
 	}
-	if !sawInfo {
-		return nil, fmt.Errorf("bad nsfe, missing required chunk INFO")
-	}
-	if !sawData {
-		return nil, fmt.Errorf("bad nsfe, missing required chunk DATA")
-	}
-	if !sawNend {
-		return nil, fmt.Errorf("bad nsfe, missing required chunk NEND")
-	}
+	return seen, nil
+}
+
+// fillDefaults gives every song an entry in the per-song
+// chunks, and drops playlist entries for songs that don't exist.
+func (parsed *parsedNsfe) fillDefaults() {
 	for i := 0; i < int(parsed.info.NumSongs); i++ {
 		if i > len(parsed.time.SongLengths)-1 {
 			parsed.time.SongLengths = append(parsed.time.SongLengths, -1)
@@ -207,7 +282,18 @@ func parseNsfe(nsfe []byte) (*parsedNsfe, error) {
 			parsed.tlbl.SongNames = append(parsed.tlbl.SongNames, "")
 		}
 	}
-	return &parsed, nil
+	if parsed.plst != nil {
+		playlist := parsed.plst.Playlist[:0]
+		for _, track := range parsed.plst.Playlist {
+			if track < parsed.info.NumSongs {
+				playlist = append(playlist, track)
+			}
+		}
+		parsed.plst.Playlist = playlist
+		if len(playlist) == 0 {
+			parsed.plst = nil
+		}
+	}
 }
 
 type plstChunk struct{ Playlist []byte }
@@ -224,6 +310,25 @@ type authChunk struct {
 type textChunk struct {
 	Text string
 }
+type psfxChunk struct{ SfxTracks []byte }
+type rateChunk struct {
+	// zero means not given
+	PlaySpeedNtsc  uint16
+	PlaySpeedPal   uint16
+	PlaySpeedDendy uint16
+}
+type regnChunk struct {
+	Regions   byte   // nsfeRegion bits, zero if not given
+	Preferred Region // RegionAuto if not given
+}
+
+// regn chunk Regions bits
+const (
+	nsfeRegionNTSC  = 0x01
+	nsfeRegionPAL   = 0x02
+	nsfeRegionDendy = 0x04
+)
+
 type infoChunk struct {
 	LoadAddr       uint16
 	InitAddr       uint16
@@ -247,31 +352,60 @@ func (hdr *nsfHeader) usesBanks() bool {
 	return false
 }
 
-func parseNsf(nsf []byte) (nsfHeader, []byte, error) {
+// parseNsf reads nsf and nsf2 files. The returned nsfe
+// is nil unless it's an nsf2 with metadata on the end.
+func parseNsf(nsf []byte) (nsfHeader, *parsedNsfe, []byte, error) {
 	hdr := nsfHeader{}
 	if err := readStructLE(nsf, &hdr); err != nil {
-		return nsfHeader{}, nil, fmt.Errorf("nsf player error\n%s", err.Error())
-	}
-	if hdr.SoundChipFlags != 0 {
-		return nsfHeader{}, nil, fmt.Errorf("nsf player error\nunimplemented chip: %v", hdr.SoundChipFlags)
-	}
-	if hdr.Version != 1 {
-		return nsfHeader{}, nil, fmt.Errorf("nsf player error\nunsupported nsf version: %v", hdr.Version)
+		return nsfHeader{}, nil, nil, fmt.Errorf("nsf player error\n%s", err.Error())
 	}
 	data := nsf[0x80:]
-	return hdr, data, nil
+	switch hdr.Version {
+	case 1:
+		hdr.Nsf2Flags, hdr.Nsf2DataLen = 0, [3]byte{} // might be junk
+		return hdr, nil, data, nil
+	case 2:
+		dataLen := hdr.getNsf2DataLen()
+		if dataLen == 0 {
+			return hdr, nil, data, nil
+		}
+		if dataLen > len(data) {
+			return nsfHeader{}, nil, nil, fmt.Errorf("nsf player error\nnsf2 data length is past the end of the file")
+		}
+		nsfe, err := parseNsf2Metadata(&hdr, data[dataLen:])
+		if err != nil {
+			return nsfHeader{}, nil, nil, fmt.Errorf("nsf player error\n%s", err.Error())
+		}
+		return hdr, nsfe, data[:dataLen], nil
+	default:
+		return nsfHeader{}, nil, nil, fmt.Errorf("nsf player error\nunsupported nsf version: %v", hdr.Version)
+	}
 }
 
 // NewNsfPlayer creates an nsfPlayer session
 func NewNsfPlayer(nsf []byte, devMode bool) Emulator {
+	return NewNsfPlayerWithOptions(nsf, Options{DevMode: devMode})
+}
 
-	var nsfe *parsedNsfe
-	var hdr nsfHeader
-	var data []byte
-	var err error
+// NewNsfPlayerWithOptions creates an nsfPlayer session with the given options
+func NewNsfPlayerWithOptions(nsf []byte, opts Options) Emulator {
+	np, err := newNsfPlayer(nsf, opts)
+	if err != nil {
+		return NewErrEmu(fmt.Sprintf("nsf player error\n%s", err.Error()))
+	}
+	np.updateScreen()
+	return np
+}
+
+// parseAnyNsf handles both nsf and nsfe files. The
+// returned nsfe is nil for plain nsfs.
+func parseAnyNsf(nsf []byte) (hdr nsfHeader, nsfe *parsedNsfe, data []byte, err error) {
+	if len(nsf) < 4 {
+		return nsfHeader{}, nil, nil, fmt.Errorf("file too short to be an nsf")
+	}
 	switch string(nsf[:4]) {
 	case "NESM":
-		hdr, data, err = parseNsf(nsf)
+		hdr, nsfe, data, err = parseNsf(nsf)
 	case "NSFE":
 		nsfe, err = parseNsfe(nsf)
 		if err == nil {
@@ -281,39 +415,80 @@ func NewNsfPlayer(nsf []byte, devMode bool) Emulator {
 	default:
 		err = fmt.Errorf("Unknown format: %q", string(nsf[:4]))
 	}
+	return hdr, nsfe, data, err
+}
+
+func newNsfPlayer(nsf []byte, opts Options) (*nsfPlayer, error) {
+
+	hdr, nsfe, data, err := parseAnyNsf(nsf)
 	if err != nil {
-		return NewErrEmu(fmt.Sprintf("nsf player error\n%s", err.Error()))
+		return nil, err
 	}
 
-	var mapper mmc
 	var cart []byte
 	if hdr.usesBanks() {
-		mapper = &mapper031{}
 		padding := hdr.LoadAddr & 0x0fff
 		cart = append(make([]byte, padding), data...)
 	} else {
-		if hdr.LoadAddr < 0x8000 {
-			return NewErrEmu("unsupported nsf parameter\nsub-0x8000 LoadAddrs")
+		if hdr.LoadAddr < 0x6000 {
+			return nil, fmt.Errorf("unsupported nsf parameter\nsub-0x6000 LoadAddrs")
+		}
+		cart = append(make([]byte, hdr.LoadAddr-0x6000), data...)
+	}
+	baseMapper := &nsfMapper{IsFDS: hdr.SoundChipFlags&nsfChipFDS != 0}
+	mapper, err := newNsfMMC(baseMapper, hdr.SoundChipFlags)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Nsf2Flags&nsf2IRQSupport != 0 {
+		mapper.IRQ = &nsf2IRQ{}
+	}
+
+	audioOutput, err := opts.getAudioOutput()
+	if err != nil {
+		return nil, err
+	}
+
+	region := opts.Region
+	if region == RegionAuto && nsfe != nil {
+		region = nsfe.regn.Preferred
+	}
+	if region == RegionAuto {
+		if hdr.isNTSC() {
+			region = RegionNTSC
+		} else {
+			region = RegionPAL
 		}
-		mapper = &mapper000{}
-		cart = make([]byte, 32*1024)
-		copy(cart[hdr.LoadAddr-0x8000:], data)
 	}
 
 	var tvBit byte
 	var playSpeed float64
-	if hdr.isNTSC() {
+	if region == RegionNTSC {
 		playSpeed = float64(hdr.PlaySpeedNtsc) / 1000000.0
 		tvBit = 0
 	} else {
-		// just go with the slightly skewed timing
-		// rather than completely fail...
+		// dendy is 50hz too, so it gets the pal rate
 		playSpeed = float64(hdr.PlaySpeedPal) / 1000000.0
 		tvBit = 1
 	}
+	if playSpeed == 0 {
+		// a tune made for only one region won't always fill in the other
+		if region == RegionNTSC {
+			playSpeed = defaultSpeedNtsc / 1000000.0
+		} else {
+			playSpeed = defaultSpeedPal / 1000000.0
+		}
+	}
+	if region == RegionDendy && nsfe != nil {
+		if nsfe.rate.PlaySpeedDendy != 0 {
+			playSpeed = float64(nsfe.rate.PlaySpeedDendy) / 1000000.0
+		}
+		if nsfe.regn.Regions&nsfeRegionDendy != 0 {
+			tvBit = 2 // only for tunes that say they know about dendy
+		}
+	}
 
-	const secondsToCycles = 60 * 29830
-	playCallInterval := int(playSpeed * secondsToCycles)
+	playCallInterval := int(playSpeed * float64(region.timing().cpuCyclesPerSecond))
 
 	np := nsfPlayer{
 		emuState: emuState{
@@ -323,29 +498,101 @@ func NewNsfPlayer(nsf []byte, devMode bool) Emulator {
 				chrROM: make([]byte, 8192),
 				PrgRAM: make([]byte, 8192),
 			},
+			Region: region,
 		},
 		PlayCallInterval: playCallInterval,
 		Hdr:              hdr,
 		HdrExtended:      nsfe,
 		TvStdBit:         tvBit,
-		devMode:          devMode,
+		AutoEnd:          opts.NsfAutoEnd,
+		SilenceLen:       opts.NsfSilenceLen,
+		devMode:          opts.DevMode,
+	}
+	if np.SilenceLen == 0 {
+		np.SilenceLen = defaultNsfSilenceLen
 	}
 	np.CPU = virt6502.Virt6502{
 		IgnoreDecimalMode: true,
 		RunCycles:         np.emuState.runCycles,
-		Write:             np.emuState.write,
-		Read:              np.emuState.read,
+		Write:             np.write,
+		Read:              np.read,
 		Err:               func(e error) { emuErr(e) },
 	}
+	np.APU.output = audioOutput
+	np.APU.scope = &np.Scope
 	np.TextDisplay = textDisplay{w: 256, h: 240, screen: np.DbgScreen[:]}
 
-	np.init()
+	if err := np.init(); err != nil {
+		return nil, err
+	}
+	if opts.WideStereo {
+		np.APU.mixer.applyWideStereo()
+	}
+	if err := np.startFirstTune(); err != nil {
+		return nil, err
+	}
 
-	np.initTune(np.Hdr.StartSong - 1)
+	return &np, nil
+}
 
-	np.updateScreen()
+func (np *nsfPlayer) startFirstTune() (err error) {
+	defer recoverEmuErr(&err)
+	if len(np.playlist()) == 0 {
+		return fmt.Errorf("nsf has no tracks to play")
+	}
+	np.PlaylistPos = np.firstPlaylistPos()
+	np.initTune(np.playlist()[np.PlaylistPos])
+	return nil
+}
 
-	return &np
+// playlist is the track order: the nsfe plst's, if there
+// is one, or else every track in order.
+func (np *nsfPlayer) playlist() []byte {
+	if np.HdrExtended != nil && np.HdrExtended.plst != nil {
+		return np.HdrExtended.plst.Playlist
+	}
+	tracks := make([]byte, np.Hdr.NumSongs)
+	for i := range tracks {
+		tracks[i] = byte(i)
+	}
+	return tracks
+}
+
+// firstPlaylistPos is where a playlist starts. Without a
+// plst that's the header's StartSong, with one it's the top.
+// A StartSong that's out of range is clamped to the playlist.
+func (np *nsfPlayer) firstPlaylistPos() int {
+	if np.HdrExtended != nil && np.HdrExtended.plst != nil {
+		return 0
+	}
+	pos := int(np.Hdr.StartSong) - 1
+	if pos > len(np.playlist())-1 {
+		pos = len(np.playlist()) - 1
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	return pos
+}
+
+func (np *nsfPlayer) isSfx(track byte) bool {
+	if np.HdrExtended == nil {
+		return false
+	}
+	return bytes.IndexByte(np.HdrExtended.psfx.SfxTracks, track) >= 0
+}
+
+// findPlaylistPos looks from the current spot in the playlist
+// in the direction of delta for a track to play, skipping sound
+// effects unless asked not to. It returns false if none is left.
+func (np *nsfPlayer) findPlaylistPos(delta int) (int, bool) {
+	playlist := np.playlist()
+	for pos := np.PlaylistPos + delta; pos >= 0 && pos < len(playlist); pos += delta {
+		if np.PlaySfx || !np.isSfx(playlist[pos]) {
+			return pos, true
+		}
+	}
+	return 0, false
 }
 
 func (np *nsfPlayer) initTune(songNum byte) {
@@ -358,15 +605,34 @@ func (np *nsfPlayer) initTune(songNum byte) {
 	for addr := uint16(0x4000); addr < 0x4014; addr++ {
 		np.write(addr, 0x00)
 	}
+	if irq := np.Mem.mmc.(*nsfMMC).IRQ; irq != nil {
+		*irq = nsf2IRQ{}
+	}
+	np.LoopDetector.reset()
 	np.write(0x4015, 0x00) // silence tracks first
 	np.write(0x4015, 0x0f)
 	np.write(0x4017, 0x40)
 
-	if np.Hdr.usesBanks() {
+	// every page gets (re)loaded, through the bank regs
+	switch {
+	case !np.Hdr.usesBanks():
+		for i := uint16(0); i < 10; i++ {
+			np.write(0x5ff6+i, byte(i))
+		}
+	case np.Hdr.SoundChipFlags&nsfChipFDS != 0:
+		// $6000 and $7000 start out like $e000 and $f000
+		np.write(0x5ff6, np.Hdr.BankVals[6])
+		np.write(0x5ff7, np.Hdr.BankVals[7])
+		fallthrough
+	default:
 		for i := uint16(0); i < 8; i++ {
 			np.write(0x5ff8+i, np.Hdr.BankVals[i])
 		}
 	}
+	if np.Hdr.SoundChipFlags&nsfChipFDS != 0 {
+		np.write(0x4080, 0x80) // volume envelope off
+		np.write(0x408a, 0xe8) // the bios's envelope speed
+	}
 
 	np.CPU.A = songNum
 	np.CPU.X = np.TvStdBit // should usually be 0 for ntsc
@@ -376,28 +642,64 @@ func (np *nsfPlayer) initTune(songNum byte) {
 	np.CPU.Push16(0x0000)
 	np.CPU.P |= virt6502.FlagIrqDisabled
 	np.CPU.PC = np.Hdr.InitAddr
-	for np.CPU.PC != 0x0001 {
-		np.step()
+	np.PlayInterrupted = false
+	if np.Hdr.Nsf2Flags&nsf2NonReturningInit != 0 {
+		// stepTune runs it, calling PLAY over it as needed
+		np.InitRunning = true
+		np.LastPlayCall = np.Cycles
+	} else {
+		for np.CPU.PC != 0x0001 {
+			np.step()
+		}
 	}
 
 	np.CurrentSong = songNum
-	np.CurrentSongLen = 0
+	np.CurrentSongStart = np.Cycles
+	np.APU.resetSilence()
+	var songLen, fadeLen time.Duration
 	ehdr := np.HdrExtended
-	if ehdr != nil {
-		songLen := ehdr.time.SongLengths[np.CurrentSong] + ehdr.fade.FadeTimes[np.CurrentSong]
-		if songLen >= 0 {
-			np.CurrentSongLen = time.Duration(songLen) * time.Millisecond
+	if ehdr != nil && ehdr.time.SongLengths[np.CurrentSong] >= 0 {
+		songLen = time.Duration(ehdr.time.SongLengths[np.CurrentSong]) * time.Millisecond
+		fadeLen = time.Duration(ehdr.fade.FadeTimes[np.CurrentSong]) * time.Millisecond
+	}
+	np.setSongLen(songLen, fadeLen)
+}
+
+// setSongLen sets when the current song ends, fading out over
+// the last fadeLen of it. Zero for both means play forever.
+func (np *nsfPlayer) setSongLen(songLen, fadeLen time.Duration) {
+	np.CurrentSongFadeLen = 0
+	np.CurrentSongLen = 0
+	np.APU.clearFade()
+	if songLen > 0 || fadeLen > 0 {
+		np.CurrentSongFadeLen = fadeLen
+		np.CurrentSongLen = songLen + fadeLen
+		if fadeLen > 0 {
+			np.APU.startFade(songLen, fadeLen)
 		}
 	}
-	np.CurrentSongStart = time.Now()
+}
+
+// getSongTime is how long the current song has been
+// playing, as counted by the emulated cpu
+func (np *nsfPlayer) getSongTime() time.Duration {
+	songCycles := np.Cycles - np.CurrentSongStart
+	seconds := float64(songCycles) / float64(np.timing().cpuCyclesPerSecond)
+	return time.Duration(seconds * float64(time.Second))
 }
 
 func (np *nsfPlayer) updateScreen() {
 
 	np.TextDisplay.clearScreen()
 
+	if np.ShowingInfo {
+		np.drawInfoPage()
+		np.DbgFlipRequested = true
+		return
+	}
+
 	np.TextDisplay.setPos(0, 1)
-	np.TextDisplay.writeString("NSF Player\n")
+	np.TextDisplay.writeString("NSF Player          SELECT:info\n")
 	np.TextDisplay.newline()
 	np.TextDisplay.writeString(string(np.Hdr.SongName[:]) + "\n")
 	np.TextDisplay.writeString(string(np.Hdr.ArtistName[:]) + "\n")
@@ -405,9 +707,13 @@ func (np *nsfPlayer) updateScreen() {
 
 	np.TextDisplay.newline()
 
-	np.TextDisplay.writeString(fmt.Sprintf("Track %02d/%02d\n", np.CurrentSong+1, np.Hdr.NumSongs))
+	np.TextDisplay.writeString(fmt.Sprintf("Track %02d/%02d", np.CurrentSong+1, np.Hdr.NumSongs))
+	if np.isSfx(np.CurrentSong) {
+		np.TextDisplay.writeString(" SFX")
+	}
+	np.TextDisplay.newline()
 
-	nowTime := int(time.Now().Sub(np.CurrentSongStart).Seconds())
+	nowTime := int(np.getSongTime().Seconds())
 	nowTimeStr := fmt.Sprintf("%02d:%02d", nowTime/60, nowTime%60)
 
 	if np.CurrentSongLen > 0 {
@@ -432,36 +738,155 @@ func (np *nsfPlayer) updateScreen() {
 		}
 		np.TextDisplay.writeString(title + "\n")
 	}
+
+	np.TextDisplay.newline()
+	np.TextDisplay.writeString("Channels (A:mute B:solo)\n")
+	np.drawChannels()
+
 	np.DbgFlipRequested = true
 }
 
+// a screen's worth, under the info page's title
+const nsfInfoLinesShown = 26
+
+// drawInfoPage shows everything the file says about
+// itself that doesn't fit on the main page, like the
+// nsfe text chunk, scrolled to InfoScroll.
+func (np *nsfPlayer) drawInfoPage() {
+	np.TextDisplay.setPos(0, 1)
+	np.TextDisplay.writeString("NSF Info            SELECT:back\n")
+	np.TextDisplay.newline()
+
+	lines := np.getInfoLines()
+	end := np.InfoScroll + nsfInfoLinesShown
+	if end > len(lines) {
+		end = len(lines)
+	}
+	for _, line := range lines[np.InfoScroll:end] {
+		np.TextDisplay.writeString(line)
+		if len(line) < 32 {
+			np.TextDisplay.newline() // full lines already wrapped
+		}
+	}
+}
+
+func (np *nsfPlayer) getInfoLines() []string {
+	var lines []string
+	add := func(str string) {
+		lines = append(lines, wrapText(str, 32)...)
+	}
+	ehdr := np.HdrExtended
+	if ehdr == nil {
+		add(getNullStr(append(np.Hdr.SongName[:], 0)))
+		add(getNullStr(append(np.Hdr.ArtistName[:], 0)))
+		add(getNullStr(append(np.Hdr.CopyrightName[:], 0)))
+		return lines
+	}
+	for _, str := range []string{ehdr.auth.GameTitle, ehdr.auth.Artist, ehdr.auth.Copyright} {
+		if str != "" {
+			add(str)
+		}
+	}
+	if ehdr.auth.Ripper != "" {
+		add("Ripped by " + ehdr.auth.Ripper)
+	}
+	if len(ehdr.psfx.SfxTracks) > 0 {
+		add("")
+		if np.PlaySfx {
+			add("Sound effects: played (A:skip)")
+		} else {
+			add("Sound effects: skipped (A:play)")
+		}
+	}
+	if ehdr.text.Text != "" {
+		add("")
+		add(ehdr.text.Text)
+	}
+	return lines
+}
+
+// wrapText splits str into lines at most width long,
+// breaking at spaces where it can.
+func wrapText(str string, width int) []string {
+	var lines []string
+	str = strings.Replace(str, "\r\n", "\n", -1)
+	for _, para := range strings.Split(str, "\n") {
+		para = strings.TrimRight(para, " ")
+		for len(para) > width {
+			split := strings.LastIndexByte(para[:width+1], ' ')
+			if split <= 0 {
+				split = width
+			}
+			lines = append(lines, para[:split])
+			para = strings.TrimLeft(para[split:], " ")
+		}
+		lines = append(lines, para)
+	}
+	return lines
+}
+
+func (np *nsfPlayer) moveChannelSelection(delta int) {
+	numChannels := len(np.APU.mixer.channels)
+	np.SelectedChannel = (np.SelectedChannel + delta + numChannels) % numChannels
+	np.updateScreen()
+}
+
+func (np *nsfPlayer) toggleSelectedChannel(toggleSolo bool) {
+	c := np.APU.mixer.channels[np.SelectedChannel]
+	if toggleSolo {
+		c.Solo = !c.Solo
+	} else {
+		c.Muted = !c.Muted
+	}
+	np.APU.mixer.setChannelMix(np.SelectedChannel, c)
+	np.updateScreen()
+}
+
 var lastInput time.Time
 
 func (np *nsfPlayer) prevSong() {
-	if np.CurrentSong > 0 {
-		np.CurrentSong--
-		np.initTune(np.CurrentSong)
+	if pos, ok := np.findPlaylistPos(-1); ok {
+		np.PlaylistPos = pos
+		np.initTune(np.playlist()[pos])
 		np.updateScreen()
 	}
 }
 func (np *nsfPlayer) nextSong() {
-	if np.CurrentSong < np.Hdr.NumSongs-1 {
-		np.CurrentSong++
-		np.initTune(np.CurrentSong)
+	if pos, ok := np.findPlaylistPos(1); ok {
+		np.PlaylistPos = pos
+		np.initTune(np.playlist()[pos])
 		np.updateScreen()
 	}
 }
+func (np *nsfPlayer) toggleInfo() {
+	np.ShowingInfo = !np.ShowingInfo
+	np.updateScreen()
+}
+func (np *nsfPlayer) scrollInfo(delta int) {
+	np.InfoScroll += delta
+	if maxScroll := len(np.getInfoLines()) - nsfInfoLinesShown; np.InfoScroll > maxScroll {
+		np.InfoScroll = maxScroll
+	}
+	if np.InfoScroll < 0 {
+		np.InfoScroll = 0
+	}
+	np.updateScreen()
+}
+func (np *nsfPlayer) togglePlaySfx() {
+	np.PlaySfx = !np.PlaySfx
+	np.updateScreen()
+}
 func (np *nsfPlayer) togglePause() {
 	np.Paused = !np.Paused
-	if np.Paused {
-		np.PauseStartTime = time.Now()
-	} else {
-		np.CurrentSongStart = np.CurrentSongStart.Add(time.Now().Sub(np.PauseStartTime))
-	}
 	np.updateScreen()
 }
 
 func (np *nsfPlayer) UpdateInput(input Input) {
+	if np.err != nil {
+		return
+	}
+	defer recoverEmuErr(&np.err)
+
 	now := time.Now()
 	if now.Sub(lastInput).Seconds() > 0.20 {
 		if input.Joypad.Left {
@@ -476,68 +901,126 @@ func (np *nsfPlayer) UpdateInput(input Input) {
 			np.togglePause()
 			lastInput = now
 		}
+		if input.Joypad.Sel {
+			np.toggleInfo()
+			lastInput = now
+		}
+		if np.ShowingInfo {
+			if input.Joypad.Up {
+				np.scrollInfo(-1)
+				lastInput = now
+			}
+			if input.Joypad.Down {
+				np.scrollInfo(1)
+				lastInput = now
+			}
+			if input.Joypad.A {
+				np.togglePlaySfx()
+				lastInput = now
+			}
+			return
+		}
+		if input.Joypad.Up {
+			np.moveChannelSelection(-1)
+			lastInput = now
+		}
+		if input.Joypad.Down {
+			np.moveChannelSelection(1)
+			lastInput = now
+		}
+		if input.Joypad.A {
+			np.toggleSelectedChannel(false)
+			lastInput = now
+		}
+		if input.Joypad.B {
+			np.toggleSelectedChannel(true)
+			lastInput = now
+		}
 	}
 }
 
-var lastScreenUpdate time.Time
-
 func (np *nsfPlayer) Step() {
+	if np.err != nil {
+		return
+	}
+	defer recoverEmuErr(&np.err)
+
 	if !np.Paused {
 
-		now := time.Now()
-		if now.Sub(lastScreenUpdate) >= 17*time.Millisecond {
-			lastScreenUpdate = now
+		screenUpdateCycles := uint64(np.timing().cpuCyclesPerSecond / 60)
+		if np.Cycles-np.LastScreenUpdate >= screenUpdateCycles {
+			np.LastScreenUpdate = np.Cycles
+			np.advancePianoRoll()
 			np.updateScreen()
 		}
-		if np.CurrentSongLen > 0 && now.Sub(np.CurrentSongStart) >= np.CurrentSongLen {
-			if np.CurrentSong < np.Hdr.NumSongs-1 {
+		if np.CurrentSongLen > 0 && np.getSongTime() >= np.CurrentSongLen || np.isSilentTooLong() {
+			if _, ok := np.findPlaylistPos(1); ok {
 				np.nextSong()
 			} else {
-				np.initTune(np.Hdr.StartSong - 1)
+				np.PlaylistPos = np.firstPlaylistPos()
+				np.initTune(np.playlist()[np.PlaylistPos])
 				if !np.Paused {
 					np.togglePause()
 				}
 			}
 		}
 
-		if np.CPU.PC == 0x0001 {
-			stepsSinceLastCall := int(np.Cycles - np.LastPlayCall)
-			if stepsSinceLastCall >= int(np.PlayCallInterval) {
-				np.LastPlayCall = np.Cycles
-				np.CPU.S = 0xfd
-				np.CPU.Push16(0x0000)
-				np.CPU.PC = np.Hdr.PlayAddr
-			}
-		}
+		np.stepTune()
+	}
+}
 
-		if np.CPU.PC != 0x0001 {
-			np.step()
+// stepTune runs the tune one instruction forward, calling
+// PLAY whenever it's due. Timing here is all emulated.
+func (np *nsfPlayer) stepTune() {
+	if np.CPU.PC == 0x0001 {
+		if np.PlayInterrupted {
+			// back to INIT, like an RTI
+			np.PlayInterrupted = false
+			np.CPU.P = np.CPU.Pop()
+			np.CPU.PC = np.CPU.Pop16()
 		} else {
-			np.runCycles(2)
+			np.InitRunning = false
 		}
 	}
-}
 
-func (np *nsfPlayer) ReadSoundBuffer(toFill []byte) []byte {
-	buf := np.APU.buffer.read(toFill)
-	if len(buf) > 0 {
-		if np.CurrentSongLen > 0 && np.HdrExtended != nil {
-			fadeLen := time.Duration(np.HdrExtended.fade.FadeTimes[np.CurrentSong]) * time.Millisecond
-			if fadeLen > 0 {
-				preFadeLen := np.CurrentSongLen - fadeLen
-				songTime := time.Now().Sub(np.CurrentSongStart)
-				if songTime >= preFadeLen && songTime <= np.CurrentSongLen {
-					fadeT := float64(songTime-preFadeLen) / float64(fadeLen)
-					for i := 0; i < len(buf); i += 2 {
-						sample := (int16(buf[i+1]) << 8) | int16(buf[i])
-						fadedSample := int16(float64(sample) * (1.0 - fadeT))
-						buf[i], buf[i+1] = byte(fadedSample), byte(fadedSample>>8)
-					}
-				}
-			}
+	stepsSinceLastCall := int(np.Cycles - np.LastPlayCall)
+	if stepsSinceLastCall >= int(np.PlayCallInterval) && np.Hdr.Nsf2Flags&nsf2NoPlay != 0 {
+		// no PLAY to call, but frames still pass
+		np.LastPlayCall = np.Cycles
+		np.endLoopFrame()
+	} else if stepsSinceLastCall >= int(np.PlayCallInterval) {
+		if np.CPU.PC == 0x0001 {
+			np.LastPlayCall = np.Cycles
+			np.endLoopFrame()
+			np.CPU.S = 0xfd
+			np.CPU.Push16(0x0000)
+			np.CPU.PC = np.Hdr.PlayAddr
+		} else if np.InitRunning && !np.PlayInterrupted {
+			// a non-returning INIT gets interrupted, NMI style
+			np.LastPlayCall = np.Cycles
+			np.endLoopFrame()
+			np.PlayInterrupted = true
+			np.CPU.Push16(np.CPU.PC)
+			np.CPU.Push(np.CPU.P)
+			np.CPU.P |= virt6502.FlagIrqDisabled
+			np.CPU.Push16(0x0000)
+			np.CPU.PC = np.Hdr.PlayAddr
 		}
 	}
-	return buf
+
+	// nsf2 irqs can come in while idle, and return to idle
+	irqDue := np.CPU.IRQ && np.CPU.LastStepsP&virt6502.FlagIrqDisabled == 0 && np.Hdr.Nsf2Flags&nsf2IRQSupport != 0
+	if np.CPU.PC != 0x0001 || irqDue {
+		np.step()
+	} else {
+		np.runCycles(2)
+	}
+}
+
+// ReadSoundBuffer doesn't pad out the buffer like emuState's,
+// as that would throw off the fade's timing
+func (np *nsfPlayer) ReadSoundBuffer(toFill []byte) []byte {
+	return np.APU.buffer.read(toFill)
 }
 
 func (np *nsfPlayer) Framebuffer() []byte {
@@ -0,0 +1,109 @@
+package famigo
+
+// nsf2 Nsf2Flags bits
+const (
+	nsf2IRQSupport       = 0x10
+	nsf2NonReturningInit = 0x20
+	nsf2NoPlay           = 0x40
+	nsf2MetadataRequired = 0x80
+)
+
+func (hdr *nsfHeader) getNsf2DataLen() int {
+	return int(hdr.Nsf2DataLen[0]) | int(hdr.Nsf2DataLen[1])<<8 | int(hdr.Nsf2DataLen[2])<<16
+}
+
+// parseNsf2Metadata reads the nsfe chunks an nsf2 can have after
+// its data. The header stays in charge of everything it covers,
+// so INFO, DATA, and BANK chunks are ignored. Unless the header
+// says the metadata is required, a bad chunk just means the
+// metadata is skipped, and nil is returned.
+func parseNsf2Metadata(hdr *nsfHeader, metadata []byte) (*parsedNsfe, error) {
+	required := hdr.Nsf2Flags&nsf2MetadataRequired != 0
+
+	parsed := parsedNsfe{}
+	parsed.auth = authChunk{
+		GameTitle: getNullStr(append(hdr.SongName[:], 0)),
+		Artist:    getNullStr(append(hdr.ArtistName[:], 0)),
+		Copyright: getNullStr(append(hdr.CopyrightName[:], 0)),
+	}
+	if _, err := parseNsfeChunks(metadata, &parsed, required); err != nil {
+		if required {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	parsed.info = infoChunk{
+		LoadAddr:       hdr.LoadAddr,
+		InitAddr:       hdr.InitAddr,
+		PlayAddr:       hdr.PlayAddr,
+		TvStdFlags:     hdr.TvStdFlags,
+		SoundChipFlags: hdr.SoundChipFlags,
+		NumSongs:       hdr.NumSongs,
+		StartSong:      hdr.StartSong - 1,
+	}
+	parsed.data = nil
+	parsed.bank = bankChunk{BankVals: hdr.BankVals}
+	parsed.applyRateAndRegn(hdr)
+	parsed.fillDefaults()
+	return &parsed, nil
+}
+
+// nsf2IRQ is the irq support an nsf2 can ask for: the irq
+// vector at $fffe becomes writable, and there's a timer at
+// $401b-$401d that counts down cpu cycles.
+type nsf2IRQ struct {
+	Vector        [2]byte
+	VectorWritten bool
+
+	TimerReload  uint16
+	TimerCounter uint16
+	TimerEnabled bool
+	IRQRequested bool
+}
+
+func (i *nsf2IRQ) runCycle() {
+	if !i.TimerEnabled {
+		return
+	}
+	if i.TimerCounter == 0 {
+		i.TimerCounter = i.TimerReload
+		i.IRQRequested = true
+	} else {
+		i.TimerCounter--
+	}
+}
+
+func (i *nsf2IRQ) writeTimerReg(addr uint16, val byte) {
+	switch addr {
+	case 0x401b:
+		i.TimerReload = i.TimerReload&0xff00 | uint16(val)
+	case 0x401c:
+		i.TimerReload = i.TimerReload&0x00ff | uint16(val)<<8
+	case 0x401d:
+		// any write acks, and restarts the count
+		i.TimerEnabled = val&0x01 == 0x01
+		i.TimerCounter = i.TimerReload
+		i.IRQRequested = false
+	}
+}
+
+// read and write are emuState's, but with the nsf2 irq timer
+// regs let through, as carts can't use that part of the map.
+// Writes are also watched for the loop detector.
+func (np *nsfPlayer) read(addr uint16) byte {
+	if addr >= 0x4018 && addr < 0x4020 && np.Hdr.Nsf2Flags&nsf2IRQSupport != 0 {
+		return np.Mem.mmc.Read(&np.Mem, addr)
+	}
+	return np.emuState.read(addr)
+}
+func (np *nsfPlayer) write(addr uint16, val byte) {
+	if np.AutoEnd && np.isSoundRegWrite(addr) {
+		np.LoopDetector.observeWrite(addr, val)
+	}
+	if addr >= 0x4018 && addr < 0x4020 && np.Hdr.Nsf2Flags&nsf2IRQSupport != 0 {
+		np.Mem.mmc.Write(&np.Mem, addr, val)
+		return
+	}
+	np.emuState.write(addr, val)
+}
@@ -0,0 +1,156 @@
+package famigo
+
+import "time"
+
+// For nsf tracks without known lengths, the player can guess at
+// where they end. A track that goes silent for long enough just
+// ends. A track that loops gets to play its loop twice, and then
+// fades out. A loop shorter than nsfLoopMatchLen has already gone
+// round more than twice by the time it's found, so it fades out
+// at the end of the time through it's found in.
+const (
+	defaultNsfSilenceLen = 3 * time.Second
+	nsfAutoFadeLen       = 8 * time.Second
+
+	// loops are found by matching this much of the track against
+	// what came before it, so a short repeated phrase inside a
+	// longer loop doesn't get taken for the loop itself
+	nsfLoopMatchLen = 10 * time.Second
+	nsfMinLoopLen   = 2 * time.Second
+
+	// output below this (after dc blocking) counts as silence.
+	// A volume 1 pulse is about ten times this.
+	nsfSilenceLevel = 0.001
+)
+
+// nsfLoopDetector watches sound register writes, hashing them
+// a frame (one PLAY call) at a time. When the last few seconds'
+// worth of frame hashes match an earlier run of them, the
+// track is taken to be looping.
+type nsfLoopDetector struct {
+	FrameHash   uint64
+	FrameHashes []uint64
+
+	// hashes of every run of MatchFrames frames seen so far,
+	// to the frame each one ended on
+	RunHashes map[uint64]int
+
+	LoopFound bool
+}
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+func fnvAdd(hash uint64, b byte) uint64 {
+	return (hash ^ uint64(b)) * fnvPrime64
+}
+
+func (d *nsfLoopDetector) reset() {
+	*d = nsfLoopDetector{FrameHash: fnvOffset64, RunHashes: map[uint64]int{}}
+}
+
+func (d *nsfLoopDetector) observeWrite(addr uint16, val byte) {
+	d.FrameHash = fnvAdd(d.FrameHash, byte(addr))
+	d.FrameHash = fnvAdd(d.FrameHash, byte(addr>>8))
+	d.FrameHash = fnvAdd(d.FrameHash, val)
+}
+
+// endFrame finishes off the current frame, returning the loop
+// length and how many frames ago the first repeat of it began,
+// if a loop has just been found. Lengths are in frames.
+func (d *nsfLoopDetector) endFrame(matchFrames, minLoopFrames int) (loopLen, repeatAge int, found bool) {
+	d.FrameHashes = append(d.FrameHashes, d.FrameHash)
+	d.FrameHash = fnvOffset64
+	if d.LoopFound || len(d.FrameHashes) < matchFrames {
+		return 0, 0, false
+	}
+
+	runHash := uint64(fnvOffset64)
+	for _, frameHash := range d.FrameHashes[len(d.FrameHashes)-matchFrames:] {
+		for i := uint(0); i < 64; i += 8 {
+			runHash = fnvAdd(runHash, byte(frameHash>>i))
+		}
+	}
+
+	now := len(d.FrameHashes) - 1
+	then, ok := d.RunHashes[runHash]
+	if !ok {
+		d.RunHashes[runHash] = now
+		return 0, 0, false
+	}
+	if now-then < minLoopFrames {
+		// e.g. a long held note. Keep the newest sighting, so
+		// a stretch of identical frames never adds up to a loop.
+		d.RunHashes[runHash] = now
+		return 0, 0, false
+	}
+	d.LoopFound = true
+	loopLen = now - then
+
+	// the match only says the repeat began at least matchFrames
+	// ago, so follow it back to where it really started
+	start := now - matchFrames + 1
+	for start-1-loopLen >= 0 && d.FrameHashes[start-1] == d.FrameHashes[start-1-loopLen] {
+		start--
+	}
+	return loopLen, now - start, true
+}
+
+// isSoundRegWrite is whether a write goes to the apu
+// or one of the nsf's expansion sound chips.
+func (np *nsfPlayer) isSoundRegWrite(addr uint16) bool {
+	m := np.Mem.mmc.(*nsfMMC)
+	switch {
+	case addr >= 0x4000 && addr < 0x4018:
+		return addr != 0x4014 && addr != 0x4016
+	case addr >= 0x4040 && addr < 0x4100:
+		return m.FDS != nil
+	case addr >= 0x4800 && addr < 0x5000:
+		return m.N163 != nil
+	case addr >= 0x5000 && addr <= 0x5015:
+		return m.MMC5 != nil
+	case addr >= 0x9000 && addr < 0xc000 && addr&0x0ffc == 0:
+		return m.VRC6 != nil
+	case addr == 0x9010 || addr == 0x9030:
+		return m.VRC7 != nil
+	case addr >= 0xc000 && addr < 0xf800:
+		return m.S5B != nil
+	case addr >= 0xf800:
+		return m.N163 != nil || m.S5B != nil
+	}
+	return false
+}
+
+// endLoopFrame is called once per PLAY. If the track turns
+// out to be looping, it's given an end and a fade out.
+func (np *nsfPlayer) endLoopFrame() {
+	if !np.AutoEnd || np.CurrentSongLen > 0 {
+		return
+	}
+	frameLen := time.Duration(float64(np.PlayCallInterval) / float64(np.timing().cpuCyclesPerSecond) * float64(time.Second))
+	matchFrames := int(nsfLoopMatchLen / frameLen)
+	minLoopFrames := int(nsfMinLoopLen / frameLen)
+	loopLen, repeatAge, found := np.LoopDetector.endFrame(matchFrames, minLoopFrames)
+	if !found {
+		return
+	}
+	// the second time through ends a loop's length after the first
+	// repeat started. If that's already gone by (as it has for loops
+	// shorter than nsfLoopMatchLen), it's the end of the current one.
+	songTime := np.getSongTime()
+	untilEnd := time.Duration(loopLen-repeatAge%loopLen) * frameLen
+	np.CurrentSongFadeLen = nsfAutoFadeLen
+	np.CurrentSongLen = songTime + untilEnd + nsfAutoFadeLen
+	np.APU.startFade(untilEnd, nsfAutoFadeLen)
+}
+
+// isSilentTooLong is whether a track of unknown length
+// has been silent long enough to count as over.
+func (np *nsfPlayer) isSilentTooLong() bool {
+	if !np.AutoEnd || np.CurrentSongLen > 0 {
+		return false
+	}
+	return np.APU.getSilenceLen() >= np.SilenceLen
+}
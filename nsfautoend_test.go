@@ -0,0 +1,160 @@
+package famigo
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	testFramesPerSecond = 60
+	testMatchFrames     = 10 * testFramesPerSecond
+	testMinLoopFrames   = 2 * testFramesPerSecond
+)
+
+// feedLoopDetector runs frames through d, each writing frameVal(i)
+// out, until endFrame finds a loop or maxFrames have gone by
+func feedLoopDetector(d *nsfLoopDetector, maxFrames int, frameVal func(int) uint16) (frame, loopLen, repeatAge int, found bool) {
+	d.reset()
+	for frame = 0; frame < maxFrames; frame++ {
+		val := frameVal(frame)
+		d.observeWrite(0x4002, byte(val))
+		d.observeWrite(0x4003, byte(val>>8))
+		if loopLen, repeatAge, found = d.endFrame(testMatchFrames, testMinLoopFrames); found {
+			return frame, loopLen, repeatAge, true
+		}
+	}
+	return frame, 0, 0, false
+}
+
+func TestLoopDetectorIgnoresHeldNote(t *testing.T) {
+	var d nsfLoopDetector
+	held := func(int) uint16 { return 0x00bf }
+	if frame, _, _, found := feedLoopDetector(&d, 30*testFramesPerSecond, held); found {
+		t.Fatalf("identical frames taken for a loop at frame %v", frame)
+	}
+}
+
+func TestLoopDetectorFindsLoop(t *testing.T) {
+	const introLen = 100
+	for _, wantLen := range []int{15 * testFramesPerSecond, 4 * testFramesPerSecond} {
+		song := func(i int) uint16 {
+			if i < introLen {
+				return uint16(0x1000 + i)
+			}
+			return uint16((i - introLen) % wantLen)
+		}
+		var d nsfLoopDetector
+		frame, loopLen, repeatAge, found := feedLoopDetector(&d, 60*testFramesPerSecond, song)
+		if !found {
+			t.Fatalf("%v frame loop not found", wantLen)
+		}
+		if loopLen != wantLen {
+			t.Fatalf("%v frame loop found as %v frames", wantLen, loopLen)
+		}
+		if repeatStart := frame - repeatAge; repeatStart != introLen+wantLen {
+			t.Fatalf("%v frame loop's repeat found starting at %v, not %v", wantLen, repeatStart, introLen+wantLen)
+		}
+	}
+}
+
+// runAutoEndTrack plays nsf with auto end on until the player gives
+// the track an end or it's gone silent, or until limit
+func runAutoEndTrack(t *testing.T, nsf []byte, limit time.Duration) *nsfPlayer {
+	t.Helper()
+	np, err := newNsfPlayer(nsf, Options{NsfAutoEnd: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for np.getSongTime() < limit && np.CurrentSongLen == 0 && !np.isSilentTooLong() {
+		np.stepTune()
+		if np.err != nil {
+			t.Fatal(np.err)
+		}
+	}
+	return np
+}
+
+// plays a note forever, no writes after INIT
+var heldNoteInit = asm(
+	asmStore(0x4015, 0x01),
+	asmStore(0x4000, 0xbf),
+	asmStore(0x4002, 0xff),
+	asmStore(0x4003, 0x00),
+	asmRTS,
+)
+
+func TestAutoEndSilence(t *testing.T) {
+	np := runAutoEndTrack(t, makeTestNsf(0, asmRTS, asmRTS), 10*time.Second)
+	if !np.isSilentTooLong() {
+		t.Fatal("silent track never ended")
+	}
+	if got := np.getSongTime(); got < defaultNsfSilenceLen || got > defaultNsfSilenceLen+100*time.Millisecond {
+		t.Fatalf("silent track ended at %v, want %v", got, defaultNsfSilenceLen)
+	}
+}
+
+func TestAutoEndHeldNote(t *testing.T) {
+	if testing.Short() {
+		t.Skip("plays 30s of emulated time")
+	}
+	// the same write every frame, on top of the held note
+	play := asm(asmStore(0x4000, 0xbf), asmRTS)
+	np := runAutoEndTrack(t, makeTestNsf(0, heldNoteInit, play), 30*time.Second)
+	if np.isSilentTooLong() {
+		t.Fatal("held note taken for silence")
+	}
+	if np.CurrentSongLen != 0 {
+		t.Fatalf("held note taken for a loop, given a length of %v", np.CurrentSongLen)
+	}
+}
+
+func TestAutoEndLoop(t *testing.T) {
+	if testing.Short() {
+		t.Skip("plays about 25s of emulated time")
+	}
+	// writes a 16-bit frame count that wraps at $300, so the
+	// track loops every 768 frames (about 12.8s)
+	longLoopPlay := asm(
+		asmCountFrame,
+		[]byte{
+			0xd0, 0x0c, // BNE +12
+			0xe6, 0x01, // INC $01
+			0xa5, 0x01, // LDA $01
+			0xc9, 0x03, // CMP #$03
+			0xd0, 0x04, // BNE +4
+			0xa9, 0x00, // LDA #$00
+			0x85, 0x01, // STA $01
+			0xa5, 0x00, // LDA $00
+		},
+		asmStoreA(0x4002),
+		[]byte{0xa5, 0x01}, // LDA $01
+		asmStoreA(0x4001),
+		asmRTS,
+	)
+	// an 8-bit frame count, looping every 256 frames (about 4.3s)
+	shortLoopPlay := asm(asmCountFrame, asmStoreA(0x4002), asmRTS)
+
+	tests := []struct {
+		play       []byte
+		loopFrames int
+		timesRound int
+	}{
+		// twice through, then the fade
+		{longLoopPlay, 0x300, 2},
+		// found 10s after the first repeat began, so it's
+		// partway through its fourth time round by then
+		{shortLoopPlay, 0x100, 4},
+	}
+	for _, test := range tests {
+		np := runAutoEndTrack(t, makeTestNsf(0, heldNoteInit, test.play), 40*time.Second)
+		if np.CurrentSongLen == 0 {
+			t.Fatalf("%v frame loop never found", test.loopFrames)
+		}
+		// the first time round starts a frame in, at the first PLAY
+		frameLen := time.Duration(float64(np.PlayCallInterval) / float64(np.timing().cpuCyclesPerSecond) * float64(time.Second))
+		want := time.Duration(test.timesRound*test.loopFrames+1)*frameLen + nsfAutoFadeLen
+		if diff := np.CurrentSongLen - want; diff < -2*frameLen || diff > 2*frameLen {
+			t.Fatalf("%v frame loop given a length of %v, want %v", test.loopFrames, np.CurrentSongLen, want)
+		}
+	}
+}
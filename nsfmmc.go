@@ -0,0 +1,193 @@
+package famigo
+
+import "fmt"
+
+// nsf SoundChipFlags bits
+const (
+	nsfChipVRC6 = 0x01
+	nsfChipVRC7 = 0x02
+	nsfChipFDS  = 0x04
+	nsfChipMMC5 = 0x08
+	nsfChipN163 = 0x10
+	nsfChip5B   = 0x20
+)
+
+// nsfMMC is what an nsf plays from: the mapper that does its
+// banking (or lack thereof), plus any expansion sound chips
+// it asks for. Chip register writes go to the chips, the
+// rest to the mapper.
+type nsfMMC struct {
+	mmc
+
+	VRC6 *vrc6Audio
+	VRC7 *vrc7Audio
+	FDS  *fdsAudio
+	MMC5 *mapper005 // just for its sound, multiplier, and exram
+	N163 *n163Audio
+	S5B  *sunsoft5BAudio
+
+	IRQ *nsf2IRQ
+}
+
+func newNsfMMC(base mmc, chipFlags byte) (*nsfMMC, error) {
+	const supportedChips = nsfChipVRC6 | nsfChipVRC7 | nsfChipFDS | nsfChipMMC5 | nsfChipN163 | nsfChip5B
+	if unsupported := chipFlags &^ supportedChips; unsupported != 0 {
+		return nil, fmt.Errorf("unimplemented sound chip flags: %02x", unsupported)
+	}
+	m := &nsfMMC{mmc: base}
+	if chipFlags&nsfChipVRC6 != 0 {
+		m.VRC6 = &vrc6Audio{}
+	}
+	if chipFlags&nsfChipVRC7 != 0 {
+		m.VRC7 = &vrc7Audio{}
+	}
+	if chipFlags&nsfChipFDS != 0 {
+		m.FDS = &fdsAudio{}
+	}
+	if chipFlags&nsfChipMMC5 != 0 {
+		m.MMC5 = &mapper005{ExRAMMode: mmc5ExRAMReadWrite}
+	}
+	if chipFlags&nsfChipN163 != 0 {
+		m.N163 = &n163Audio{}
+	}
+	if chipFlags&nsfChip5B != 0 {
+		m.S5B = &sunsoft5BAudio{}
+	}
+	return m, nil
+}
+
+func (m *nsfMMC) SoundChips() []soundChip {
+	var chips []soundChip
+	if m.VRC6 != nil {
+		chips = append(chips, m.VRC6)
+	}
+	if m.VRC7 != nil {
+		chips = append(chips, m.VRC7)
+	}
+	if m.FDS != nil {
+		chips = append(chips, m.FDS)
+	}
+	if m.MMC5 != nil {
+		chips = append(chips, &m.MMC5.Audio)
+	}
+	if m.N163 != nil {
+		chips = append(chips, m.N163)
+	}
+	if m.S5B != nil {
+		chips = append(chips, m.S5B)
+	}
+	return chips
+}
+
+func (m *nsfMMC) RunCycle(emu *emuState) {
+	if m.IRQ != nil {
+		m.IRQ.runCycle()
+		if m.IRQ.IRQRequested {
+			emu.CPU.IRQ = true // level triggered, held until ack'd
+		}
+	}
+	m.mmc.RunCycle(emu)
+}
+
+func (m *nsfMMC) Read(mem *mem, addr uint16) byte {
+	if m.IRQ != nil {
+		if addr >= 0x4018 && addr < 0x4020 {
+			return 0xff // timer regs are write only
+		}
+		if addr >= 0xfffe && m.IRQ.VectorWritten {
+			return m.IRQ.Vector[addr-0xfffe]
+		}
+	}
+	if m.FDS != nil && addr >= 0x4040 && addr < 0x4100 {
+		return m.FDS.readReg(addr)
+	}
+	if m.N163 != nil && addr >= 0x4800 && addr < 0x5000 {
+		return m.N163.readData()
+	}
+	if m.MMC5 != nil && isNsfMMC5Addr(addr) {
+		return m.MMC5.Read(mem, addr)
+	}
+	return m.mmc.Read(mem, addr)
+}
+
+func (m *nsfMMC) Write(mem *mem, addr uint16, val byte) {
+	switch {
+	case m.IRQ != nil && addr >= 0x4018 && addr < 0x4020:
+		m.IRQ.writeTimerReg(addr, val)
+	case m.IRQ != nil && addr >= 0xfffe:
+		if !m.IRQ.VectorWritten {
+			m.IRQ.Vector[0] = m.mmc.Read(mem, 0xfffe)
+			m.IRQ.Vector[1] = m.mmc.Read(mem, 0xffff)
+			m.IRQ.VectorWritten = true
+		}
+		m.IRQ.Vector[addr-0xfffe] = val
+	case m.VRC6 != nil && addr >= 0x9000 && addr < 0xc000 && addr&0x0ffc == 0:
+		m.VRC6.writeReg(addr, val)
+	case m.VRC7 != nil && addr == 0x9010:
+		m.VRC7.writeAddr(val)
+	case m.VRC7 != nil && addr == 0x9030:
+		m.VRC7.writeData(val)
+	case m.FDS != nil && addr >= 0x4040 && addr < 0x4100:
+		m.FDS.writeReg(addr, val)
+	case m.MMC5 != nil && isNsfMMC5Addr(addr):
+		m.MMC5.Write(mem, addr, val)
+	case m.N163 != nil && addr >= 0x4800 && addr < 0x5000:
+		m.N163.writeData(val)
+	case m.N163 != nil && addr >= 0xf800:
+		m.N163.writeAddr(val)
+	case m.S5B != nil && addr >= 0xc000 && addr < 0xe000:
+		m.S5B.writeAddr(val)
+	case m.S5B != nil && addr >= 0xe000:
+		m.S5B.writeData(val)
+	default:
+		m.mmc.Write(mem, addr, val)
+	}
+}
+
+// isNsfMMC5Addr is whether addr is one of the mmc5 regs nsfs
+// can use: sound, the multiplier, or exram (as plain ram, up to
+// where the nsf bank regs start)
+func isNsfMMC5Addr(addr uint16) bool {
+	return addr >= 0x5000 && addr <= 0x5015 ||
+		addr == 0x5205 || addr == 0x5206 ||
+		addr >= 0x5c00 && addr < 0x5ff6
+}
+
+// nsfMapper is the nsf memory map: ram at $6000-$7fff, and rom
+// at $8000-$ffff, all in 4k pages. Writing a bank number to a
+// page's reg, at $5ff6-$5fff, copies that bank's data in, so the
+// ram pages can be bankswitched too. Unbanked nsfs are padded so
+// that their banks are just the pages from $6000 on in order.
+// FDS nsfs get ram all the way up, so their "rom" is writable.
+type nsfMapper struct {
+	mapper031
+
+	IsFDS bool
+	RAM   [40 * 1024]byte // $6000-$ffff
+}
+
+func (m *nsfMapper) Init(mem *mem) {}
+
+func (m *nsfMapper) Read(mem *mem, addr uint16) byte {
+	if addr >= 0x6000 {
+		return m.RAM[addr-0x6000]
+	}
+	return 0xff
+}
+
+func (m *nsfMapper) Write(mem *mem, addr uint16, val byte) {
+	switch {
+	case addr >= 0x5ff6 && addr < 0x6000:
+		page := m.RAM[int(addr-0x5ff6)*4*1024:][:4*1024]
+		for i := range page {
+			page[i] = 0
+		}
+		if bankStart := int(val) * 4 * 1024; bankStart < len(mem.prgROM) {
+			copy(page, mem.prgROM[bankStart:])
+		}
+	case addr >= 0x6000 && addr < 0x8000:
+		m.RAM[addr-0x6000] = val
+	case addr >= 0x8000 && m.IsFDS:
+		m.RAM[addr-0x6000] = val
+	}
+}
@@ -0,0 +1,109 @@
+package famigo
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// NsfInfo is the header info of an nsf/nsfe file
+type NsfInfo struct {
+	Title     string
+	Artist    string
+	Copyright string
+
+	StartTrack int // zero-based, like RenderNsfTrack's track
+	Tracks     []NsfTrack
+	Playlist   []int // track order, zero-based, if the file gives one
+}
+
+// NsfTrack is what's known about a single track. Plain nsfs
+// don't know track lengths, so they're left as zero.
+type NsfTrack struct {
+	Name       string
+	Length     time.Duration // not including the fade
+	FadeLength time.Duration
+
+	IsSoundEffect bool
+}
+
+// ParseNsfInfo reads the header info out of an nsf/nsfe file
+func ParseNsfInfo(nsf []byte) (NsfInfo, error) {
+	hdr, nsfe, _, err := parseAnyNsf(nsf)
+	if err != nil {
+		return NsfInfo{}, err
+	}
+	info := NsfInfo{
+		Title:      strings.TrimRight(getNullStr(append(hdr.SongName[:], 0)), " "),
+		Artist:     strings.TrimRight(getNullStr(append(hdr.ArtistName[:], 0)), " "),
+		Copyright:  strings.TrimRight(getNullStr(append(hdr.CopyrightName[:], 0)), " "),
+		StartTrack: int(hdr.StartSong) - 1,
+		Tracks:     make([]NsfTrack, hdr.NumSongs),
+	}
+	if nsfe != nil {
+		// don't get cut short by the nsf header's name lengths
+		info.Title, info.Artist, info.Copyright = nsfe.auth.GameTitle, nsfe.auth.Artist, nsfe.auth.Copyright
+		for i := range info.Tracks {
+			info.Tracks[i].Name = nsfe.tlbl.SongNames[i]
+			if songLen := nsfe.time.SongLengths[i]; songLen >= 0 {
+				info.Tracks[i].Length = time.Duration(songLen) * time.Millisecond
+				info.Tracks[i].FadeLength = time.Duration(nsfe.fade.FadeTimes[i]) * time.Millisecond
+			}
+		}
+		for _, track := range nsfe.psfx.SfxTracks {
+			if int(track) < len(info.Tracks) {
+				info.Tracks[track].IsSoundEffect = true
+			}
+		}
+		if nsfe.plst != nil {
+			for _, track := range nsfe.plst.Playlist {
+				info.Playlist = append(info.Playlist, int(track))
+			}
+		}
+	}
+	return info, nil
+}
+
+// RenderNsfTrack plays a track (zero-based) for length, then fades it
+// out over fadeLength, writing the sound to w in the format chosen by
+// opts. It runs as fast as it can, and only emulated time is used, so
+// the same inputs always render the same output.
+func RenderNsfTrack(w io.Writer, nsf []byte, track int, length, fadeLength time.Duration, opts Options) error {
+	np, err := newNsfPlayer(nsf, opts)
+	if err != nil {
+		return err
+	}
+	if track < 0 || track >= int(np.Hdr.NumSongs) {
+		return fmt.Errorf("no track %v in nsf, it has %v", track+1, np.Hdr.NumSongs)
+	}
+	return np.renderTrack(w, byte(track), length, fadeLength)
+}
+
+func (np *nsfPlayer) renderTrack(w io.Writer, track byte, length, fadeLength time.Duration) (err error) {
+	defer recoverEmuErr(&err)
+
+	np.initTune(track)
+	np.APU.buffer = apuCircleBuf{} // drop anything left over from the first tune
+	np.setSongLen(length, fadeLength)
+
+	frameSize := np.APU.output.frameSize()
+	toWrite := int(np.APU.output.durationToSamples(length+fadeLength)) * frameSize
+
+	chunk := make([]byte, 1024*frameSize)
+	for toWrite > 0 {
+		toRead := chunk
+		if toWrite < len(toRead) {
+			toRead = toRead[:toWrite]
+		}
+		for int(np.APU.buffer.size()) < len(toRead) {
+			np.stepTune()
+		}
+		buf := np.APU.buffer.read(toRead)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		toWrite -= len(buf)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package famigo
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// starts a pulse, the triangle, and the noise going,
+// then bends the pulse's pitch a little every frame
+var apuTestInit = asm(
+	asmStore(0x4015, 0x0f),
+	asmStore(0x4000, 0xbf), // duty 2, constant volume 15
+	asmStore(0x4001, 0x00),
+	asmStore(0x4002, 0xff),
+	asmStore(0x4003, 0x00),
+	asmStore(0x4008, 0x81),
+	asmStore(0x400a, 0x40),
+	asmStore(0x400b, 0x01),
+	asmStore(0x400c, 0x34),
+	asmStore(0x400e, 0x05),
+	asmStore(0x400f, 0x08),
+	asmRTS,
+)
+var apuTestPlay = asm(asmCountFrame, asmStoreA(0x4002), asmRTS)
+
+func TestRenderNsfTrackLengthAndFade(t *testing.T) {
+	const sampleRate = 22050
+	nsf := makeTestNsf(0, apuTestInit, apuTestPlay)
+	pcm := renderTestTrack(t, nsf, time.Second, 500*time.Millisecond, Options{SampleRate: sampleRate})
+
+	const frameSize = 4 // stereo 16-bit
+	if want := sampleRate * 3 / 2 * frameSize; len(pcm) != want {
+		t.Fatalf("got %v bytes, want %v for 1.5s", len(pcm), want)
+	}
+
+	body := pcmRMS(pcm[:sampleRate*frameSize])
+	if body < 0.01 {
+		t.Fatalf("render is silent (rms %v)", body)
+	}
+	// the last tenth of the fade is at most 10% volume
+	tail := pcmRMS(pcm[len(pcm)-sampleRate/20*frameSize:])
+	if tail > body*0.1 {
+		t.Fatalf("fade tail isn't quieter: rms %v, against %v before the fade", tail, body)
+	}
+}
+
+func TestRenderNsfTrackIsDeterministic(t *testing.T) {
+	nsf := makeTestNsf(0, apuTestInit, apuTestPlay)
+	first := renderTestTrack(t, nsf, time.Second, 500*time.Millisecond, Options{})
+	second := renderTestTrack(t, nsf, time.Second, 500*time.Millisecond, Options{})
+	if !bytes.Equal(first, second) {
+		i := 0
+		for i < len(first) && i < len(second) && first[i] == second[i] {
+			i++
+		}
+		t.Fatalf("renders differ at byte %v (lengths %v and %v)", i, len(first), len(second))
+	}
+}
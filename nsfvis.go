@@ -0,0 +1,225 @@
+package famigo
+
+import (
+	"fmt"
+	"math"
+)
+
+// The nsf player's main page shows a row per channel, each with
+// an oscilloscope, and under them a piano roll, scrolling right
+// to left, of the notes every channel is playing.
+const (
+	nsfScopeLen    = 256 // samples kept, per channel
+	nsfScopeCycles = 96  // cpu cycles per sample, so about 14ms kept
+
+	nsfRowsTop      = 96 // just under the "Channels" line
+	nsfRowMinHeight = 8
+	nsfRowMaxHeight = 16
+	nsfScopeX       = 156
+	nsfScopeW       = 100
+
+	nsfRollH       = 72 // one pixel per semitone
+	nsfRollTop     = 240 - nsfRollH
+	nsfRollLowNote = 24 // C1, so the roll goes up to B6
+)
+
+// nsfScope keeps the recent output of every channel,
+// sampled every nsfScopeCycles. It's fed by the apu.
+type nsfScope struct {
+	CycleCount int
+	Pos        int // where the next sample goes
+	Samples    [][nsfScopeLen]float64
+}
+
+func (s *nsfScope) observe(levels *[numAPUChannels]byte, chipLevels []float64) {
+	s.CycleCount++
+	if s.CycleCount < nsfScopeCycles {
+		return
+	}
+	s.CycleCount = 0
+	if len(s.Samples) != numAPUChannels+len(chipLevels) {
+		s.Samples = make([][nsfScopeLen]float64, numAPUChannels+len(chipLevels))
+	}
+	for i, level := range levels {
+		s.Samples[i][s.Pos] = float64(level)
+	}
+	for i, level := range chipLevels {
+		s.Samples[numAPUChannels+i][s.Pos] = level
+	}
+	s.Pos = (s.Pos + 1) % nsfScopeLen
+}
+
+// getWindow gives the nsfScopeW samples of channel c to show,
+// lined up on a rising edge so that waves hold still, along
+// with the range of values in them.
+func (s *nsfScope) getWindow(c int) (window []float64, lo, hi float64) {
+	var samples [nsfScopeLen]float64
+	if c < len(s.Samples) {
+		n := copy(samples[:], s.Samples[c][s.Pos:])
+		copy(samples[n:], s.Samples[c][:s.Pos])
+	}
+	lo, hi = samples[0], samples[0]
+	for _, v := range samples {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	mid := (lo + hi) / 2
+	start := nsfScopeLen - nsfScopeW
+	for i := start; i > 0; i-- {
+		if samples[i-1] < mid && samples[i] >= mid {
+			start = i
+			break
+		}
+	}
+	return samples[start : start+nsfScopeW], lo, hi
+}
+
+// getNotes is what every channel is playing, apu's then chips'
+func (apu *apu) getNotes() []channelNote {
+	notes := make([]channelNote, numAPUChannels+len(apu.chipLevels))
+	if apu.Pulse1.sweepTargetInRange() {
+		notes[pulse1Channel] = apu.Pulse1.getNote()
+	}
+	if apu.Pulse2.sweepTargetInRange() {
+		notes[pulse2Channel] = apu.Pulse2.getNote()
+	}
+	notes[triangleChannel] = apu.Triangle.getNote()
+	chipNotes := notes[numAPUChannels:]
+	for _, chip := range apu.soundChips {
+		n := len(chip.channelNames())
+		chip.getNotes(chipNotes[:n])
+		chipNotes = chipNotes[n:]
+	}
+	return notes
+}
+
+// a channel's color is picked by its index
+var nsfChannelColors = [][3]byte{
+	{0xff, 0x50, 0x50}, {0xff, 0xa0, 0x30}, {0x50, 0xa0, 0xff},
+	{0xc0, 0xc0, 0xc0}, {0xa0, 0x70, 0xff}, {0x50, 0xe0, 0x70},
+	{0xff, 0xe0, 0x40}, {0x40, 0xe0, 0xe0}, {0xff, 0x70, 0xc0},
+}
+
+func nsfChannelColor(c int, brightness float64) [3]byte {
+	color := nsfChannelColors[c%len(nsfChannelColors)]
+	for i := range color {
+		color[i] = byte(float64(color[i]) * brightness)
+	}
+	return color
+}
+
+func (np *nsfPlayer) isChannelHeard(c int) bool {
+	channels := np.APU.mixer.channels
+	anySolo := false
+	for _, ch := range channels {
+		anySolo = anySolo || ch.Solo
+	}
+	return !channels[c].Muted && (channels[c].Solo || !anySolo)
+}
+
+func setPixel(screen []byte, x, y int, color [3]byte) {
+	i := (y*256 + x) * 4
+	screen[i], screen[i+1], screen[i+2], screen[i+3] = color[0], color[1], color[2], 0xff
+}
+
+// advancePianoRoll scrolls the roll one pixel left,
+// drawing what's playing now down its right edge.
+func (np *nsfPlayer) advancePianoRoll() {
+	roll := np.PianoRoll[:]
+	for y := 0; y < nsfRollH; y++ {
+		line := roll[y*256*4 : (y+1)*256*4]
+		copy(line, line[4:])
+		color := [3]byte{}
+		if (nsfRollLowNote+nsfRollH-1-y)%12 == 0 {
+			color = [3]byte{0x30, 0x30, 0x30} // C lines
+		}
+		setPixel(roll, 255, y, color)
+	}
+
+	cpuHz := float64(np.timing().cpuCyclesPerSecond)
+	for c, note := range np.APU.getNotes() {
+		if note.Period == 0 || note.Volume == 0 || !np.isChannelHeard(c) {
+			continue
+		}
+		midiNote := 69 + 12*math.Log2(cpuHz/note.Period/440)
+		y := nsfRollH - 1 - int(math.Floor(midiNote+0.5)-nsfRollLowNote)
+		if y >= 0 && y < nsfRollH {
+			setPixel(roll, 255, y, nsfChannelColor(c, 0.35+0.65*note.Volume))
+		}
+	}
+}
+
+// drawChannels draws the channel rows, and the piano roll
+// under them. When there are too many rows to fit, the ones
+// around the selected channel are shown.
+func (np *nsfPlayer) drawChannels() {
+	channels := np.APU.mixer.channels
+	rowsSpace := nsfRollTop - nsfRowsTop
+	rowH := rowsSpace / len(channels)
+	if rowH > nsfRowMaxHeight {
+		rowH = nsfRowMaxHeight
+	}
+	if rowH < nsfRowMinHeight {
+		rowH = nsfRowMinHeight
+	}
+	numRows := rowsSpace / rowH
+	first := 0
+	if len(channels) > numRows {
+		first = np.SelectedChannel - numRows/2
+		if first < 0 {
+			first = 0
+		}
+		if first > len(channels)-numRows {
+			first = len(channels) - numRows
+		}
+	}
+
+	for row := 0; row < numRows && first+row < len(channels); row++ {
+		c := first + row
+		rowY := nsfRowsTop + row*rowH
+
+		cursor := " "
+		if c == np.SelectedChannel {
+			cursor = ">"
+		}
+		state := ""
+		if channels[c].Muted {
+			state += "M"
+		}
+		if channels[c].Solo {
+			state += "S"
+		}
+		pan := ""
+		if p := channels[c].Pan; p < 0 {
+			pan = fmt.Sprintf("L%d", int(-p*100+0.5))
+		} else if p > 0 {
+			pan = fmt.Sprintf("R%d", int(p*100+0.5))
+		}
+		np.TextDisplay.x, np.TextDisplay.y = 0, rowY+(rowH-8)/2
+		np.TextDisplay.writeString(fmt.Sprintf("%s%-12.12s%-2s%-3s", cursor, channels[c].Name, state, pan))
+
+		brightness := 1.0
+		if !np.isChannelHeard(c) {
+			brightness = 0.3
+		}
+		color := nsfChannelColor(c, brightness)
+		window, lo, hi := np.Scope.getWindow(c)
+		lastY := -1
+		for x, v := range window {
+			y := rowY + rowH/2
+			if hi > lo {
+				y = rowY + rowH - 2 - int((v-lo)/(hi-lo)*float64(rowH-3)+0.5)
+			}
+			// join up the jumps, so square waves have edges
+			fromY, toY := y, y
+			if lastY >= 0 {
+				fromY, toY = minInt(y, lastY), maxInt(y, lastY)
+			}
+			for drawY := fromY; drawY <= toY; drawY++ {
+				setPixel(np.DbgScreen[:], nsfScopeX+x, drawY, color)
+			}
+			lastY = y
+		}
+	}
+
+	copy(np.DbgScreen[nsfRollTop*256*4:], np.PianoRoll[:])
+}
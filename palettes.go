@@ -1,5 +1,7 @@
 package famigo
 
+import "math"
+
 // All these are generated by bisqwit's ntsc palette tool.
 //
 // He remains awesome.
@@ -1593,3 +1595,83 @@ var ntscPaletteConSat = []byte{
 	0, 0, 0,
 	0, 0, 0,
 }
+
+// palPalette is built the same way as the ntsc ones, but
+// decoded as PAL. PAL's line-by-line phase alternation cancels
+// out the 2C07's hue errors, so it's decoded directly, with no
+// hue shift or saturation boost. (There are no measured 2C07
+// colors here to tune it against, so it's left at that.)
+var palPalette = generatePalette()
+
+// generatePalette decodes the ppu's composite signal for every
+// color and emphasis combination
+func generatePalette() []byte {
+	// signal voltages, relative to sync
+	const black, white, attenuation = 0.518, 1.962, 0.746
+	levels := [8]float64{
+		0.350, 0.518, 0.962, 1.550, // signal low
+		1.094, 1.506, 1.962, 1.962, // signal high
+	}
+	inColorPhase := func(color, phase int) bool {
+		return (color+phase)%12 < 6
+	}
+	signal := func(nesColor, emphasis, phase int) float64 {
+		color := nesColor & 0x0f
+		level := (nesColor >> 4) & 0x03
+		if color > 13 {
+			level = 1
+		}
+		low, high := levels[level], levels[4+level]
+		if color == 0 {
+			low = high
+		}
+		if color > 12 {
+			high = low
+		}
+		v := low
+		if inColorPhase(color, phase) {
+			v = high
+		}
+		if color < 14 {
+			if (emphasis&1 != 0 && inColorPhase(0, phase)) ||
+				(emphasis&2 != 0 && inColorPhase(4, phase)) ||
+				(emphasis&4 != 0 && inColorPhase(8, phase)) {
+				v *= attenuation
+			}
+		}
+		return (v - black) / (white - black)
+	}
+	clamp := func(f float64) byte {
+		f *= 255
+		if f < 0 {
+			return 0
+		}
+		if f > 255 {
+			return 255
+		}
+		return byte(f + 0.5)
+	}
+
+	const ntscHue = 105.0 // lines the hues up with the ntsc palettes
+	hueShift := ntscHue * math.Pi / 180
+	palette := make([]byte, 0, 8*64*3)
+	for emphasis := 0; emphasis < 8; emphasis++ {
+		for nesColor := 0; nesColor < 64; nesColor++ {
+			var y, i, q float64
+			for phase := 0; phase < 12; phase++ {
+				v := signal(nesColor, emphasis, phase)
+				angle := math.Pi*(float64(phase)+0.5)/6 + hueShift
+				y += v
+				i += v * math.Cos(angle)
+				q += v * math.Sin(angle)
+			}
+			y, i, q = y/12, i/12, q/12
+			palette = append(palette,
+				clamp(y+0.946882*i+0.623557*q),
+				clamp(y-0.274788*i-0.635691*q),
+				clamp(y-1.108545*i+1.709007*q),
+			)
+		}
+	}
+	return palette
+}
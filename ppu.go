@@ -17,6 +17,9 @@ type ppu struct {
 	TempAddrReg uint16 // handles scroll, nametables... see ppu docs
 	AddrReg     uint16
 	FineScrollX byte
+	// latched with the horizontal scroll bits so games setting
+	// fineX mid-line don't affect the line being drawn
+	FineScrollXCopy byte
 
 	AddrRegSelector byte
 	DataReadBuffer  byte
@@ -112,7 +115,6 @@ func (ppu *ppu) parseOAM() {
 func (ppu *ppu) getPatternDataForParsedOAM(emu *emuState, y byte) {
 	for i := range ppu.OAMBeingParsed {
 		entry := &ppu.OAMBeingParsed[i]
-		tileID := entry.TileField
 		var spriteY byte
 		height := byte(8)
 		if ppu.UseBigSprites {
@@ -123,20 +125,31 @@ func (ppu *ppu) getPatternDataForParsedOAM(emu *emuState, y byte) {
 		} else {
 			spriteY = y - entry.Y
 		}
-		patternTbl := uint16(0x0000)
-		if ppu.UseUpperSpritePatternTable || (ppu.UseBigSprites && (tileID&0x01 == 0x01)) {
-			patternTbl = 0x1000
+		patternAddr := ppu.getSpritePatternAddr(entry.TileField, spriteY)
+		entry.PatternsForScanline = ppu.getPatternsForSpriteAtY(emu, patternAddr, spriteY)
+	}
+	if ppu.ShowBG || ppu.ShowSprites {
+		// the ppu always fetches 8 sprites, using tile $ff for
+		// empty slots. Mappers that watch A12 depend on this.
+		for i := len(ppu.OAMBeingParsed); i < 8; i++ {
+			ppu.getPatternsForSpriteAtY(emu, ppu.getSpritePatternAddr(0xff, 0), 0)
 		}
-		if ppu.UseBigSprites {
-			if spriteY >= 8 {
-				tileID |= 0x01
-			} else {
-				tileID &^= 0x01
-			}
+	}
+}
+
+func (ppu *ppu) getSpritePatternAddr(tileID byte, spriteY byte) uint16 {
+	patternTbl := uint16(0x0000)
+	if ppu.UseUpperSpritePatternTable || (ppu.UseBigSprites && (tileID&0x01 == 0x01)) {
+		patternTbl = 0x1000
+	}
+	if ppu.UseBigSprites {
+		if spriteY >= 8 {
+			tileID |= 0x01
+		} else {
+			tileID &^= 0x01
 		}
-		patternAddr := patternTbl | (uint16(tileID) << 4)
-		entry.PatternsForScanline = ppu.getPatternsForSpriteAtY(emu, patternAddr, spriteY)
 	}
+	return patternTbl | (uint16(tileID) << 4)
 }
 
 const (
@@ -168,8 +181,9 @@ func getPaletteRAMAddr(addr uint16) uint16 {
 	return (addr - 0x3f00) & 0x1f
 }
 
-func (ppu *ppu) writeDataReg(mem *mem, val byte) {
+func (ppu *ppu) writeDataReg(emu *emuState, val byte) {
 
+	mem := &emu.Mem
 	addr := ppu.AddrReg & 0x3fff // NOTE: make sure this mask isn't hiding bugs!
 	if addr >= 0x3f00 && addr < 0x4000 {
 		addr = getPaletteRAMAddr(addr)
@@ -180,16 +194,12 @@ func (ppu *ppu) writeDataReg(mem *mem, val byte) {
 	} else {
 		mem.mmc.WriteVRAM(mem, addr, val)
 	}
-	if ppu.IncrementStyleSelector == incrementBigStride {
-		ppu.AddrReg += 0x20
-	} else {
-		ppu.AddrReg++
-	}
-	ppu.AddrReg &= 0x7fff // only a 15 bit reg
+	ppu.incrementAddrReg(emu)
 }
 
-func (ppu *ppu) readDataReg(mem *mem) byte {
+func (ppu *ppu) readDataReg(emu *emuState) byte {
 	var val byte
+	mem := &emu.Mem
 	addr := ppu.AddrReg & 0x3fff // NOTE: make sure this mask isn't hiding bugs!
 	if addr >= 0x3f00 && addr < 0x4000 {
 		addr = getPaletteRAMAddr(addr)
@@ -204,16 +214,21 @@ func (ppu *ppu) readDataReg(mem *mem) byte {
 		val = ppu.DataReadBuffer
 		ppu.DataReadBuffer = mem.mmc.ReadVRAM(mem, addr)
 	}
+	ppu.incrementAddrReg(emu)
+	return val
+}
+
+func (ppu *ppu) incrementAddrReg(emu *emuState) {
 	if ppu.IncrementStyleSelector == incrementBigStride {
 		ppu.AddrReg += 0x20
 	} else {
 		ppu.AddrReg++
 	}
 	ppu.AddrReg &= 0x7fff // only a 15 bit reg
-	return val
+	ppu.putAddrOnBus(emu, ppu.AddrReg)
 }
 
-func (ppu *ppu) writeAddrReg(val byte) {
+func (ppu *ppu) writeAddrReg(emu *emuState, val byte) {
 	if ppu.AddrRegSelector == 0 {
 		ppu.TempAddrReg &^= 0xff00
 		ppu.TempAddrReg |= uint16(val&0x3f) << 8 // yes 3, we clear the top scroll bit for some reason, here
@@ -223,6 +238,7 @@ func (ppu *ppu) writeAddrReg(val byte) {
 		ppu.TempAddrReg |= uint16(val)
 		ppu.AddrReg = ppu.TempAddrReg
 		ppu.AddrRegSelector = 0
+		ppu.putAddrOnBus(emu, ppu.AddrReg)
 	}
 }
 func (ppu *ppu) readAddrReg() byte {
@@ -275,7 +291,7 @@ func (ppu *ppu) getCurrentNametableTileAddr() uint16 {
 	return 0x2000 | ppu.AddrReg&0x0fff // 0x2000 | nametableSel | coarseY | coarseX
 }
 func (ppu *ppu) getCurrentNametableByte(emu *emuState) byte {
-	return ppu.read(emu, ppu.getCurrentNametableTileAddr())
+	return ppu.renderRead(emu, ppu.getCurrentNametableTileAddr(), bgNametableFetch)
 }
 
 func (ppu *ppu) getCurrentNametableAttributeAddr() uint16 {
@@ -285,7 +301,7 @@ func (ppu *ppu) getCurrentNametableAttributeAddr() uint16 {
 	return addr
 }
 func (ppu *ppu) getCurrentAttributeByte(emu *emuState) byte {
-	return ppu.read(emu, ppu.getCurrentNametableAttributeAddr())
+	return ppu.renderRead(emu, ppu.getCurrentNametableAttributeAddr(), bgAttributeFetch)
 }
 
 func (ppu *ppu) getBGPatternAddr(tileID byte) uint16 {
@@ -297,8 +313,8 @@ func (ppu *ppu) getBGPatternAddr(tileID byte) uint16 {
 }
 func (ppu *ppu) getCurrentTileBytes(emu *emuState, tileID byte) (byte, byte) {
 	patternAddr := ppu.getBGPatternAddr(tileID) + uint16(ppu.getFineScrollY()&0x07)
-	patternPlane0 := ppu.read(emu, patternAddr)
-	patternPlane1 := ppu.read(emu, patternAddr+8)
+	patternPlane0 := ppu.renderRead(emu, patternAddr, bgPatternFetch)
+	patternPlane1 := ppu.renderRead(emu, patternAddr+8, bgPatternFetch)
 	return patternPlane0, patternPlane1
 }
 
@@ -310,8 +326,8 @@ func (ppu *ppu) getPatternBG(x byte) byte {
 
 func (ppu *ppu) getPatternsForSpriteAtY(emu *emuState, patternAddr uint16, y byte) [8]byte {
 	patternAddr += uint16(y & 0x07)
-	patternPlane0 := ppu.read(emu, patternAddr)
-	patternPlane1 := ppu.read(emu, patternAddr+8)
+	patternPlane0 := ppu.renderRead(emu, patternAddr, spritePatternFetch)
+	patternPlane1 := ppu.renderRead(emu, patternAddr+8, spritePatternFetch)
 	result := [8]byte{}
 	for x := byte(0); x < 8; x++ {
 		patternBit0 := (patternPlane0 >> (7 - (x & 0x07))) & 0x01
@@ -325,26 +341,61 @@ func (ppu *ppu) read(emu *emuState, addr uint16) byte {
 	return emu.Mem.mmc.ReadVRAM(&emu.Mem, addr)
 }
 
-var defaultPalette = ntscPaletteSat
+type ppuFetchKind int
+
+const (
+	bgNametableFetch ppuFetchKind = iota
+	bgAttributeFetch
+	bgPatternFetch
+	spritePatternFetch
+)
+
+// ppuFetch tells the mmc what a rendering fetch is for
+type ppuFetch struct {
+	Kind  ppuFetchKind
+	TileX int // screen column of the tile, for bg fetches
+}
+
+func (ppu *ppu) renderRead(emu *emuState, addr uint16, kind ppuFetchKind) byte {
+	if !ppu.ShowBG && !ppu.ShowSprites {
+		// no real fetches happen when rendering is off
+		return ppu.read(emu, addr)
+	}
+	fetch := ppuFetch{
+		Kind:  kind,
+		TileX: (ppu.LineX + int(ppu.FineScrollXCopy)) >> 3,
+	}
+	ppu.putAddrOnBus(emu, addr)
+	return emu.Mem.mmc.ReadVRAMForRender(&emu.Mem, addr, fetch)
+}
 
-func (ppu *ppu) getRGB(nesColor byte) (byte, byte, byte) {
+func (ppu *ppu) putAddrOnBus(emu *emuState, addr uint16) {
+	emu.Mem.mmc.ObservePPUAddr(emu, addr&0x3fff)
+}
+
+func (ppu *ppu) getRGB(timing *regionTiming, nesColor byte) (byte, byte, byte) {
 	if ppu.UseGreyscale {
 		nesColor &= 0x30
 	}
+	emphasizeRed, emphasizeGreen := ppu.EmphasizeRed, ppu.EmphasizeGreen
+	if timing.swapsRedAndGreen {
+		emphasizeRed, emphasizeGreen = emphasizeGreen, emphasizeRed
+	}
 	emphasisSelector := uint(0)
-	if ppu.EmphasizeRed {
+	if emphasizeRed {
 		emphasisSelector |= 1
 	}
-	if ppu.EmphasizeGreen {
+	if emphasizeGreen {
 		emphasisSelector |= 2
 	}
 	if ppu.EmphasizeBlue {
 		emphasisSelector |= 4
 	}
-	ntscPalIndex := uint(nesColor)
-	return defaultPalette[emphasisSelector*64*3+ntscPalIndex*3],
-		defaultPalette[emphasisSelector*64*3+ntscPalIndex*3+1],
-		defaultPalette[emphasisSelector*64*3+ntscPalIndex*3+2]
+	palIndex := uint(nesColor)
+	palette := timing.palette
+	return palette[emphasisSelector*64*3+palIndex*3],
+		palette[emphasisSelector*64*3+palIndex*3+1],
+		palette[emphasisSelector*64*3+palIndex*3+2]
 }
 
 func (ppu *ppu) getPaletteIDFromAttributeByte(attributes byte, tileX, tileY byte) byte {
@@ -403,11 +454,10 @@ func (ppu *ppu) getBGTileX() byte     { return byte(ppu.AddrReg) & 0x1f }
 func (ppu *ppu) getBGTileY() byte     { return byte(ppu.AddrReg>>5) & 0x1f }
 func (ppu *ppu) getFineScrollY() byte { return byte(ppu.AddrReg>>12) & 0x07 }
 
-// FIXME: (hopefully) temp hack due to timing issues (games setting fineX before we're ready)
-var fineScrollXCopy byte
-
 func (ppu *ppu) runCycle(emu *emuState) {
 
+	timing := emu.timing()
+
 	if ppu.ManuallyGenerateNMI {
 		ppu.ManuallyGenerateNMI = false
 		ppu.ManuallyGenerateNMIWaitingForStep = true
@@ -421,14 +471,14 @@ func (ppu *ppu) runCycle(emu *emuState) {
 	}
 
 	if ppu.PPUCyclesSinceYInc == 0 {
-		if ppu.LineY == -1 && (ppu.ShowBG || ppu.ShowSprites) && ppu.FrameCounter&0x01 == 0x01 {
+		if timing.skipsOddFrameDot && ppu.LineY == -1 && (ppu.ShowBG || ppu.ShowSprites) && ppu.FrameCounter&0x01 == 0x01 {
 			ppu.PPUCyclesSinceYInc++ // skip 0th cycle
 		}
 	}
 
 	switch ppu.PPUCyclesSinceYInc {
 	case 1:
-		if ppu.LineY == 241 {
+		if ppu.LineY == timing.vblankStartLine {
 			ppu.FrameCounter++
 			if ppu.LastVBlankReset != ppu.PPUCycles {
 				ppu.VBlankAlert = true
@@ -450,7 +500,7 @@ func (ppu *ppu) runCycle(emu *emuState) {
 			ppu.getPatternDataForParsedOAM(emu, byte(ppu.LineY+1))
 			if ppu.ShowBG || ppu.ShowSprites {
 				ppu.copyHorizontalScrollBits()
-				fineScrollXCopy = ppu.FineScrollX
+				ppu.FineScrollXCopy = ppu.FineScrollX
 			}
 		}
 	case 304:
@@ -459,14 +509,14 @@ func (ppu *ppu) runCycle(emu *emuState) {
 			if ppu.ShowBG || ppu.ShowSprites {
 				ppu.copyVerticalScrollBits()
 				ppu.copyHorizontalScrollBits()
-				fineScrollXCopy = ppu.FineScrollX
+				ppu.FineScrollXCopy = ppu.FineScrollX
 			}
 		}
 	case 341:
 		ppu.PPUCyclesSinceYInc = 0
 		ppu.LineX = 0
 		ppu.LineY++
-		if ppu.LineY == 261 {
+		if ppu.LineY == timing.scanlinesPerFrame-1 {
 			ppu.LineY = -1
 		}
 	}
@@ -484,7 +534,7 @@ func (ppu *ppu) runCycle(emu *emuState) {
 				bgPattern := byte(0)
 
 				if ppu.ShowBG && (ppu.LineX >= 8 || ppu.ShowBGInLeftBorder) {
-					bgPattern = ppu.getPatternBG(byte(ppu.LineX) + fineScrollXCopy)
+					bgPattern = ppu.getPatternBG(byte(ppu.LineX) + ppu.FineScrollXCopy)
 					if bgPattern != 0 {
 						attributeByte := ppu.CurrentAttributeByte
 						paletteID := ppu.getPaletteIDFromAttributeByte(attributeByte, ppu.getBGTileX(), ppu.getBGTileY())
@@ -524,14 +574,14 @@ func (ppu *ppu) runCycle(emu *emuState) {
 				}
 
 				if ppu.LineY != -1 {
-					r, g, b := ppu.getRGB(color)
+					r, g, b := ppu.getRGB(timing, color)
 					ppu.FrameBuffer[ppu.LineY*256*4+ppu.LineX*4] = r
 					ppu.FrameBuffer[ppu.LineY*256*4+ppu.LineX*4+1] = g
 					ppu.FrameBuffer[ppu.LineY*256*4+ppu.LineX*4+2] = b
 					ppu.FrameBuffer[ppu.LineY*256*4+ppu.LineX*4+3] = 0xff
 
 					ppu.LineX++
-					if (byte(ppu.LineX)+fineScrollXCopy)&0x07 == 0 {
+					if (byte(ppu.LineX)+ppu.FineScrollXCopy)&0x07 == 0 {
 						if ppu.ShowBG || ppu.ShowSprites {
 							ppu.incrementHorizontalScrollBits()
 
@@ -0,0 +1,119 @@
+package famigo
+
+// Region is the console timing standard being emulated
+type Region int
+
+const (
+	// RegionAuto means use the cart/nsf header's timing
+	RegionAuto Region = iota
+	// RegionNTSC is the north american/japanese 2A03/2C02
+	RegionNTSC
+	// RegionPAL is the european 2A07/2C07
+	RegionPAL
+	// RegionDendy is the common famiclone timing: PAL
+	// frame rate, but NTSC-like cpu and apu
+	RegionDendy
+)
+
+func (r Region) String() string {
+	switch r {
+	case RegionAuto:
+		return "Auto"
+	case RegionNTSC:
+		return "NTSC"
+	case RegionPAL:
+		return "PAL"
+	case RegionDendy:
+		return "Dendy"
+	}
+	return "Unknown"
+}
+
+type regionTiming struct {
+	cpuCyclesPerSecond int
+
+	// ppu dots per cpu cycle, as a fraction
+	ppuDotsPerCPUCycleNum int
+	ppuDotsPerCPUCycleDen int
+
+	scanlinesPerFrame int
+	vblankStartLine   int
+	skipsOddFrameDot  bool
+
+	noisePeriods []uint16
+	dmcPeriods   []uint16
+
+	// cpu half-cycle counts at which the frame counter
+	// clocks things, for 4 and 5 step mode respectively
+	frameCounterSteps4 [4]uint64
+	frameCounterSteps5 [4]uint64
+
+	palette          []byte
+	swapsRedAndGreen bool // emphasis bits
+}
+
+var ntscTiming = regionTiming{
+	cpuCyclesPerSecond:    1789773,
+	ppuDotsPerCPUCycleNum: 3,
+	ppuDotsPerCPUCycleDen: 1,
+	scanlinesPerFrame:     262,
+	vblankStartLine:       241,
+	skipsOddFrameDot:      true,
+	noisePeriods:          noisePeriodTable,
+	dmcPeriods:            dmcPeriodTable,
+	frameCounterSteps4:    [4]uint64{2*3728 + 1, 2*7456 + 1, 2*11185 + 1, 2*14914 + 1},
+	frameCounterSteps5:    [4]uint64{2*3728 + 1, 2*7456 + 1, 2*11185 + 1, 2*18640 + 1},
+	palette:               ntscPaletteSat,
+}
+
+var palTiming = regionTiming{
+	cpuCyclesPerSecond:    1662607,
+	ppuDotsPerCPUCycleNum: 16,
+	ppuDotsPerCPUCycleDen: 5,
+	scanlinesPerFrame:     312,
+	vblankStartLine:       241,
+	noisePeriods:          palNoisePeriodTable,
+	dmcPeriods:            palDMCPeriodTable,
+	frameCounterSteps4:    [4]uint64{2*4156 + 1, 2*8313 + 1, 2*12469 + 1, 2*16626 + 1},
+	frameCounterSteps5:    [4]uint64{2*4156 + 1, 2*8313 + 1, 2*12469 + 1, 2*20782 + 1},
+	palette:               palPalette,
+	swapsRedAndGreen:      true,
+}
+
+var dendyTiming = regionTiming{
+	cpuCyclesPerSecond:    1773448,
+	ppuDotsPerCPUCycleNum: 3,
+	ppuDotsPerCPUCycleDen: 1,
+	scanlinesPerFrame:     312,
+	vblankStartLine:       291, // 51 idle lines after the picture, then a normal length vblank
+	noisePeriods:          noisePeriodTable,
+	dmcPeriods:            dmcPeriodTable,
+	frameCounterSteps4:    ntscTiming.frameCounterSteps4,
+	frameCounterSteps5:    ntscTiming.frameCounterSteps5,
+	palette:               palPalette,
+	swapsRedAndGreen:      true,
+}
+
+func (r Region) timing() *regionTiming {
+	switch r {
+	case RegionPAL:
+		return &palTiming
+	case RegionDendy:
+		return &dendyTiming
+	}
+	return &ntscTiming
+}
+
+func (emu *emuState) timing() *regionTiming {
+	return emu.Region.timing()
+}
+
+func getRegionFromTimingMode(mode TimingMode) Region {
+	switch mode {
+	case TimingPAL:
+		return RegionPAL
+	case TimingDendy:
+		return RegionDendy
+	}
+	return RegionNTSC // multi-region carts too
+}
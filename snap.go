@@ -9,7 +9,7 @@ import (
 	"io/ioutil"
 )
 
-const currentSnapshotVersion = 3
+const currentSnapshotVersion = 4
 
 const infoString = "famigo snapshot"
 
@@ -69,6 +69,14 @@ func (emu *emuState) convertLatestSnapshot(snap *snapshot) (*emuState, error) {
 	newState.CPU.Err = func(e error) { emuErr(e) }
 
 	newState.devMode = emu.devMode
+	newState.APU.output = emu.APU.output
+	newState.APU.mixer = emu.APU.mixer
+	newState.APU.mixer.changed = true
+	// pick up the sound from what's already been heard, so the load doesn't pop
+	newState.APU.buffer = emu.APU.buffer
+	newState.APU.lastCorrectedSample = emu.APU.lastCorrectedSample
+	newState.APU.resyncOutput = true
+	newState.APU.attachSoundChips(newState.Mem.mmc.SoundChips())
 
 	return &newState, nil
 }
@@ -82,6 +90,9 @@ var snapshotConverters = map[int]func(map[string]interface{}) error{
 
 	// added 2018-12-21
 	2: convertSnap2To3,
+
+	// added 2026-10-17
+	3: convertSnap3To4,
 }
 
 // added 2018-06-13
@@ -138,6 +149,13 @@ func convertSnap2To3(state map[string]interface{}) error {
 	return nil
 }
 
+// added 2026-10-17
+func convertSnap3To4(state map[string]interface{}) error {
+	// everything was ntsc before regions were added
+	state["Region"] = RegionNTSC
+	return nil
+}
+
 func (emu *emuState) convertOldSnapshot(snap *snapshot) (*emuState, error) {
 
 	var state map[string]interface{}
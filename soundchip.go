@@ -0,0 +1,29 @@
+package famigo
+
+// soundChip is an expansion sound chip, living on a cart (or
+// in an nsf player). Its channels are mixed in after the apu's
+// own, and show up in the mixer right after them.
+type soundChip interface {
+	channelNames() []string
+
+	// runCycle is called once per cpu cycle
+	runCycle()
+
+	// getOutputs fills in the current output of each channel.
+	// 1.0 is about as loud as the apu's full mix.
+	getOutputs(outputs []float64)
+
+	// getNotes fills in what each channel is playing
+	getNotes(notes []channelNote)
+}
+
+// channelNote is what a channel is playing, for the nsf visualizer
+type channelNote struct {
+	Period float64 // in cpu cycles, zero if silent or unpitched
+	Volume float64 // 0-1
+}
+
+// apuPulseStep is the apu's output for one volume step of a
+// single pulse channel at full volume. Most chip docs describe
+// their levels relative to the apu pulses, so it's a handy unit.
+const apuPulseStep = 95.88 / (8128.0/15 + 100) / 15
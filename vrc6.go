@@ -0,0 +1,353 @@
+package famigo
+
+import "fmt"
+
+// mapper024 is Konami's VRC6. Mapper 26 is the same board
+// with the A0 and A1 lines swapped.
+type mapper024 struct {
+	SwapsA0A1 bool
+	IsChrRAM  bool
+
+	PrgBank16Number int // $8000-$bfff
+	PrgBank8Number  int // $c000-$dfff
+
+	ChrBanks       [8]int // 1k units
+	ChrBankingMode byte
+	// in the 2k banking modes, whether a bank's low bit is ignored
+	// (giving a real 2k bank), or A10 comes from it (giving a 1k
+	// bank seen twice)
+	ChrA10FromPPU bool
+
+	VramMirroring MirrorInfo
+
+	IRQ  vrcIRQ
+	VRC6 vrc6Audio
+}
+
+func (m *mapper024) Init(mem *mem) {}
+func (m *mapper024) Marshal() marshalledMMC {
+	if m.SwapsA0A1 {
+		return marshalMMC(26, m)
+	}
+	return marshalMMC(24, m)
+}
+func (m *mapper024) ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte {
+	return m.ReadVRAM(mem, addr)
+}
+func (m *mapper024) ObservePPUAddr(emu *emuState, addr uint16) {}
+func (m *mapper024) SoundChips() []soundChip                   { return []soundChip{&m.VRC6} }
+
+func (m *mapper024) RunCycle(emu *emuState) {
+	m.IRQ.runCycle(emu)
+}
+
+func (m *mapper024) Read(mem *mem, addr uint16) byte {
+	if addr >= 0x6000 && addr < 0x8000 {
+		// ram enable bit in $b003, ignored for easier compat
+		return mem.PrgRAM[int(addr-0x6000)&(len(mem.PrgRAM)-1)]
+	}
+	if addr >= 0x8000 && addr < 0xc000 {
+		return mem.prgROM[16*1024*m.PrgBank16Number+int(addr-0x8000)]
+	}
+	if addr >= 0xc000 && addr < 0xe000 {
+		return mem.prgROM[8*1024*m.PrgBank8Number+int(addr-0xc000)]
+	}
+	if addr >= 0xe000 {
+		offset := len(mem.prgROM) - 8*1024 // last bank
+		return mem.prgROM[offset+int(addr-0xe000)]
+	}
+	return 0xff
+}
+
+func (m *mapper024) Write(mem *mem, addr uint16, val byte) {
+	if addr >= 0x6000 && addr < 0x8000 {
+		mem.PrgRAM[int(addr-0x6000)&(len(mem.PrgRAM)-1)] = val
+		return
+	}
+	if addr < 0x8000 {
+		return
+	}
+
+	reg := addr & 0xf003
+	if m.SwapsA0A1 {
+		reg = reg&0xf000 | (reg&0x01)<<1 | (reg&0x02)>>1
+	}
+
+	switch reg & 0xf000 {
+	case 0x8000:
+		m.PrgBank16Number = wrapBank(int(val&0x0f), mem.prgROM, 16*1024)
+	case 0x9000, 0xa000:
+		m.VRC6.writeReg(reg, val)
+	case 0xb000:
+		if reg == 0xb003 {
+			m.writePPUBankingReg(val)
+		} else {
+			m.VRC6.writeReg(reg, val)
+		}
+	case 0xc000:
+		m.PrgBank8Number = wrapBank(int(val&0x1f), mem.prgROM, 8*1024)
+	case 0xd000:
+		m.ChrBanks[reg&0x03] = wrapBank(int(val), mem.chrROM, 1024)
+	case 0xe000:
+		m.ChrBanks[4+reg&0x03] = wrapBank(int(val), mem.chrROM, 1024)
+	case 0xf000:
+		switch reg & 0x03 {
+		case 0:
+			m.IRQ.writeLatch(val)
+		case 1:
+			m.IRQ.writeControl(val)
+		case 2:
+			m.IRQ.writeAck()
+		}
+	}
+}
+
+func (m *mapper024) writePPUBankingReg(val byte) {
+	m.ChrBankingMode = val & 0x03
+	m.ChrA10FromPPU = val&0x20 == 0x20
+	// NOTE: nametables from chr rom (bit 4) aren't supported,
+	// no known game uses them.
+	switch (val >> 2) & 0x03 {
+	case 0:
+		m.VramMirroring = VerticalMirroring
+	case 1:
+		m.VramMirroring = HorizontalMirroring
+	case 2:
+		m.VramMirroring = OneScreenLowerMirroring
+	case 3:
+		m.VramMirroring = OneScreenUpperMirroring
+	}
+}
+
+func (m *mapper024) getChrAddr(addr uint16) int {
+	slot := int(addr >> 10)
+	switch {
+	case m.ChrBankingMode == 0:
+		return m.ChrBanks[slot]*1024 + int(addr&0x03ff)
+	case m.ChrBankingMode == 1:
+		return m.get2kChrAddr(m.ChrBanks[slot>>1], addr)
+	case addr < 0x1000: // modes 2 and 3
+		return m.ChrBanks[slot]*1024 + int(addr&0x03ff)
+	default:
+		return m.get2kChrAddr(m.ChrBanks[4+(slot-4)>>1], addr)
+	}
+}
+
+func (m *mapper024) get2kChrAddr(bank int, addr uint16) int {
+	if m.ChrA10FromPPU {
+		return (bank&^0x01)*1024 + int(addr&0x07ff)
+	}
+	return bank*1024 + int(addr&0x03ff)
+}
+
+func (m *mapper024) getVRAMAddr(addr uint16) uint16 {
+	switch m.VramMirroring {
+	case VerticalMirroring:
+		return vertMirrorVRAMAddr(addr)
+	case HorizontalMirroring:
+		return horizMirrorVRAMAddr(addr)
+	case OneScreenLowerMirroring:
+		return oneScreenLowerVRAMAddr(addr)
+	default:
+		return oneScreenUpperVRAMAddr(addr)
+	}
+}
+
+func (m *mapper024) ReadVRAM(mem *mem, addr uint16) byte {
+	var val byte
+	switch {
+	case addr < 0x2000:
+		val = mem.chrROM[m.getChrAddr(addr)]
+	case addr >= 0x2000 && addr < 0x3000:
+		val = mem.InternalVRAM[m.getVRAMAddr(addr)]
+	default:
+		emuErr(fmt.Sprintf("mapper024: unimplemented vram access: read(%04x)", addr))
+	}
+	return val
+}
+
+func (m *mapper024) WriteVRAM(mem *mem, addr uint16, val byte) {
+	switch {
+	case addr < 0x2000:
+		if m.IsChrRAM {
+			mem.chrROM[m.getChrAddr(addr)] = val
+		}
+	case addr >= 0x2000 && addr < 0x3000:
+		mem.InternalVRAM[m.getVRAMAddr(addr)] = val
+	default:
+		emuErr(fmt.Sprintf("mapper024: unimplemented vram access: write(%04x, %02x)", addr, val))
+	}
+}
+
+// vrc6Audio is the VRC6's sound: two pulses with 8 duty
+// settings and a volume each, plus a sawtooth.
+type vrc6Audio struct {
+	Pulse1 vrc6Pulse
+	Pulse2 vrc6Pulse
+	Saw    vrc6Saw
+
+	Halted    bool
+	FreqShift byte // $9003 can speed up all channels by 16x or 256x
+}
+
+type vrc6Pulse struct {
+	Volume     byte
+	Duty       byte
+	IgnoreDuty bool
+	Enabled    bool
+	Period     uint16
+	Timer      uint16
+	DutyStep   byte // counts down from 15
+}
+
+type vrc6Saw struct {
+	Rate        byte
+	Enabled     bool
+	Period      uint16
+	Timer       uint16
+	Step        byte // 14 per waveform period
+	Accumulator byte
+}
+
+func (v *vrc6Audio) channelNames() []string {
+	return []string{"VRC6 Pulse 1", "VRC6 Pulse 2", "VRC6 Saw"}
+}
+
+// writeReg takes addrs in their $9000-$b002 form
+func (v *vrc6Audio) writeReg(addr uint16, val byte) {
+	switch addr {
+	case 0x9000, 0x9001, 0x9002:
+		v.Pulse1.writeReg(addr&0x03, val)
+	case 0x9003:
+		v.Halted = val&0x01 == 0x01
+		switch {
+		case val&0x04 == 0x04:
+			v.FreqShift = 8
+		case val&0x02 == 0x02:
+			v.FreqShift = 4
+		default:
+			v.FreqShift = 0
+		}
+	case 0xa000, 0xa001, 0xa002:
+		v.Pulse2.writeReg(addr&0x03, val)
+	case 0xb000, 0xb001, 0xb002:
+		v.Saw.writeReg(addr&0x03, val)
+	}
+}
+
+func (v *vrc6Audio) runCycle() {
+	if v.Halted {
+		return
+	}
+	v.Pulse1.runCycle(v.FreqShift)
+	v.Pulse2.runCycle(v.FreqShift)
+	v.Saw.runCycle(v.FreqShift)
+}
+
+func (v *vrc6Audio) getOutputs(outputs []float64) {
+	outputs[0] = float64(v.Pulse1.getLevel()) * apuPulseStep
+	outputs[1] = float64(v.Pulse2.getLevel()) * apuPulseStep
+	outputs[2] = float64(v.Saw.getLevel()) * apuPulseStep
+}
+
+func (v *vrc6Audio) getNotes(notes []channelNote) {
+	notes[0] = v.Pulse1.getNote(v.FreqShift)
+	notes[1] = v.Pulse2.getNote(v.FreqShift)
+	notes[2] = v.Saw.getNote(v.FreqShift)
+	if v.Halted {
+		notes[0], notes[1], notes[2] = channelNote{}, channelNote{}, channelNote{}
+	}
+}
+
+func (p *vrc6Pulse) writeReg(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		p.IgnoreDuty = val&0x80 == 0x80
+		p.Duty = (val >> 4) & 0x07
+		p.Volume = val & 0x0f
+	case 1:
+		p.Period = p.Period&0x0f00 | uint16(val)
+	case 2:
+		p.Period = p.Period&0x00ff | uint16(val&0x0f)<<8
+		p.Enabled = val&0x80 == 0x80
+		if !p.Enabled {
+			p.DutyStep = 15
+		}
+	}
+}
+
+func (p *vrc6Pulse) runCycle(freqShift byte) {
+	if !p.Enabled {
+		return
+	}
+	if p.Timer == 0 {
+		p.Timer = p.Period >> freqShift
+		p.DutyStep = (p.DutyStep - 1) & 0x0f
+	} else {
+		p.Timer--
+	}
+}
+
+func (p *vrc6Pulse) getLevel() byte {
+	if p.Enabled && (p.IgnoreDuty || p.DutyStep <= p.Duty) {
+		return p.Volume
+	}
+	return 0
+}
+
+func (p *vrc6Pulse) getNote(freqShift byte) channelNote {
+	if !p.Enabled || p.Volume == 0 || p.IgnoreDuty {
+		return channelNote{}
+	}
+	return channelNote{Period: 16 * float64(p.Period>>freqShift+1), Volume: float64(p.Volume) / 15}
+}
+
+func (s *vrc6Saw) writeReg(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		s.Rate = val & 0x3f
+	case 1:
+		s.Period = s.Period&0x0f00 | uint16(val)
+	case 2:
+		s.Period = s.Period&0x00ff | uint16(val&0x0f)<<8
+		s.Enabled = val&0x80 == 0x80
+		if !s.Enabled {
+			s.Step = 0
+			s.Accumulator = 0
+		}
+	}
+}
+
+func (s *vrc6Saw) runCycle(freqShift byte) {
+	if !s.Enabled {
+		return
+	}
+	if s.Timer == 0 {
+		s.Timer = s.Period >> freqShift
+		s.Step++
+		if s.Step == 14 {
+			s.Step = 0
+			s.Accumulator = 0
+		} else if s.Step&0x01 == 0 {
+			s.Accumulator += s.Rate
+		}
+	} else {
+		s.Timer--
+	}
+}
+
+func (s *vrc6Saw) getLevel() byte {
+	return s.Accumulator >> 3
+}
+
+func (s *vrc6Saw) getNote(freqShift byte) channelNote {
+	if !s.Enabled || s.Rate == 0 {
+		return channelNote{}
+	}
+	// rates over 42 overflow the accumulator, so that's the loudest
+	rate := s.Rate
+	if rate > 42 {
+		rate = 42
+	}
+	return channelNote{Period: 14 * float64(s.Period>>freqShift+1), Volume: float64(rate) / 42}
+}
@@ -0,0 +1,511 @@
+package famigo
+
+import (
+	"fmt"
+	"math"
+)
+
+// mapper085 is Konami's VRC7. The VRC7a (Lagrange Point) puts its
+// second registers at $x010, the VRC7b at $x008, so both are taken.
+type mapper085 struct {
+	IsChrRAM bool
+
+	PrgBanks [3]int // $8000, $a000, $c000, in 8k units
+	ChrBanks [8]int // 1k each
+
+	VramMirroring MirrorInfo
+	PrgRAMEnabled bool
+
+	IRQ   vrcIRQ
+	Audio vrc7Audio
+}
+
+func (m *mapper085) Init(mem *mem)          {}
+func (m *mapper085) Marshal() marshalledMMC { return marshalMMC(85, m) }
+func (m *mapper085) ReadVRAMForRender(mem *mem, addr uint16, fetch ppuFetch) byte {
+	return m.ReadVRAM(mem, addr)
+}
+func (m *mapper085) ObservePPUAddr(emu *emuState, addr uint16) {}
+func (m *mapper085) SoundChips() []soundChip                   { return []soundChip{&m.Audio} }
+
+func (m *mapper085) RunCycle(emu *emuState) {
+	m.IRQ.runCycle(emu)
+}
+
+func (m *mapper085) Read(mem *mem, addr uint16) byte {
+	switch {
+	case addr >= 0x6000 && addr < 0x8000:
+		if m.PrgRAMEnabled {
+			return mem.PrgRAM[int(addr-0x6000)&(len(mem.PrgRAM)-1)]
+		}
+		return 0xff
+	case addr >= 0x8000 && addr < 0xe000:
+		slot := int(addr-0x8000) / (8 * 1024)
+		return mem.prgROM[m.PrgBanks[slot]*8*1024+int(addr&0x1fff)]
+	case addr >= 0xe000:
+		offset := len(mem.prgROM) - 8*1024 // last bank
+		return mem.prgROM[offset+int(addr-0xe000)]
+	}
+	return 0xff
+}
+
+func (m *mapper085) Write(mem *mem, addr uint16, val byte) {
+	if addr >= 0x6000 && addr < 0x8000 {
+		if m.PrgRAMEnabled {
+			mem.PrgRAM[int(addr-0x6000)&(len(mem.PrgRAM)-1)] = val
+		}
+		return
+	}
+	if addr < 0x8000 {
+		return
+	}
+
+	isSecondReg := addr&0x18 != 0
+	switch addr & 0xf000 {
+	case 0x8000:
+		if isSecondReg {
+			m.PrgBanks[1] = wrapBank(int(val&0x3f), mem.prgROM, 8*1024)
+		} else {
+			m.PrgBanks[0] = wrapBank(int(val&0x3f), mem.prgROM, 8*1024)
+		}
+	case 0x9000:
+		switch {
+		case addr&0x30 == 0x10:
+			m.Audio.writeAddr(val)
+		case addr&0x30 == 0x30:
+			m.Audio.writeData(val)
+		case !isSecondReg:
+			m.PrgBanks[2] = wrapBank(int(val&0x3f), mem.prgROM, 8*1024)
+		}
+	case 0xa000, 0xb000, 0xc000, 0xd000:
+		slot := int(addr-0xa000) >> 12 * 2
+		if isSecondReg {
+			slot++
+		}
+		m.ChrBanks[slot] = wrapBank(int(val), mem.chrROM, 1024)
+	case 0xe000:
+		if isSecondReg {
+			m.IRQ.writeLatch(val)
+		} else {
+			switch val & 0x03 {
+			case 0:
+				m.VramMirroring = VerticalMirroring
+			case 1:
+				m.VramMirroring = HorizontalMirroring
+			case 2:
+				m.VramMirroring = OneScreenLowerMirroring
+			case 3:
+				m.VramMirroring = OneScreenUpperMirroring
+			}
+			m.Audio.Silenced = val&0x40 == 0x40
+			m.PrgRAMEnabled = val&0x80 == 0x80
+		}
+	case 0xf000:
+		if isSecondReg {
+			m.IRQ.writeAck()
+		} else {
+			m.IRQ.writeControl(val)
+		}
+	}
+}
+
+func (m *mapper085) getVRAMAddr(addr uint16) uint16 {
+	switch m.VramMirroring {
+	case VerticalMirroring:
+		return vertMirrorVRAMAddr(addr)
+	case HorizontalMirroring:
+		return horizMirrorVRAMAddr(addr)
+	case OneScreenLowerMirroring:
+		return oneScreenLowerVRAMAddr(addr)
+	default:
+		return oneScreenUpperVRAMAddr(addr)
+	}
+}
+
+func (m *mapper085) ReadVRAM(mem *mem, addr uint16) byte {
+	var val byte
+	switch {
+	case addr < 0x2000:
+		val = mem.chrROM[m.ChrBanks[addr>>10]*1024+int(addr&0x03ff)]
+	case addr >= 0x2000 && addr < 0x3000:
+		val = mem.InternalVRAM[m.getVRAMAddr(addr)]
+	default:
+		emuErr(fmt.Sprintf("mapper085: unimplemented vram access: read(%04x)", addr))
+	}
+	return val
+}
+
+func (m *mapper085) WriteVRAM(mem *mem, addr uint16, val byte) {
+	switch {
+	case addr < 0x2000:
+		if m.IsChrRAM {
+			mem.chrROM[m.ChrBanks[addr>>10]*1024+int(addr&0x03ff)] = val
+		}
+	case addr >= 0x2000 && addr < 0x3000:
+		mem.InternalVRAM[m.getVRAMAddr(addr)] = val
+	default:
+		emuErr(fmt.Sprintf("mapper085: unimplemented vram access: write(%04x, %02x)", addr, val))
+	}
+}
+
+// vrc7Audio is the VRC7's FM synth, a cut down YM2413 (OPLL):
+// six 2-operator channels, 15 built-in instruments and one custom
+// one. It's all integer math, with the same log-sin and exp table
+// approach as the real chip, so renders are exactly repeatable.
+type vrc7Audio struct {
+	Addr        byte
+	CustomPatch [8]byte
+	Channels    [6]vrc7Channel
+	Silenced    bool // mapper 85 can switch the sound off
+
+	CycleCount  int
+	SampleCount uint32 // drives the envelope, vibrato, and tremolo timing
+}
+
+type vrc7Channel struct {
+	Fnum       uint16 // 9 bits
+	Block      byte
+	KeyOn      bool
+	Sustain    bool
+	Instrument byte
+	Volume     byte
+
+	Mod vrc7Slot
+	Car vrc7Slot
+
+	Output int
+}
+
+// vrc7Slot is one operator
+type vrc7Slot struct {
+	Phase    uint32 // 19 bits, one full wave
+	Env      int    // 7 bits of attenuation, 0.375dB each
+	EnvState byte
+	Outputs  [2]int // last two, for the modulator's feedback
+}
+
+const (
+	vrc7EnvDamp = iota // quickly silence what was playing before an attack
+	vrc7EnvAttack
+	vrc7EnvDecay
+	vrc7EnvSustain
+	vrc7EnvRelease
+)
+
+const (
+	vrc7CPUCyclesPerSample = 36 // the chip's 3.58MHz clock / 72, in nes cpu cycles
+	vrc7EnvMax             = 127
+)
+
+// the built-in instruments, 1-15 (0 is the custom one)
+var vrc7Patches = [16][8]byte{
+	{},
+	{0x03, 0x21, 0x05, 0x06, 0xe8, 0x81, 0x42, 0x27},
+	{0x13, 0x41, 0x14, 0x0d, 0xd8, 0xf6, 0x23, 0x12},
+	{0x11, 0x11, 0x08, 0x08, 0xfa, 0xb2, 0x20, 0x12},
+	{0x31, 0x61, 0x0c, 0x07, 0xa8, 0x64, 0x61, 0x27},
+	{0x32, 0x21, 0x1e, 0x06, 0xe1, 0x76, 0x01, 0x28},
+	{0x02, 0x01, 0x06, 0x00, 0xa3, 0xe2, 0xf4, 0xf4},
+	{0x21, 0x61, 0x1d, 0x07, 0x82, 0x81, 0x11, 0x07},
+	{0x23, 0x21, 0x22, 0x17, 0xa2, 0x72, 0x01, 0x17},
+	{0x35, 0x11, 0x25, 0x00, 0x40, 0x73, 0x72, 0x01},
+	{0xb5, 0x01, 0x0f, 0x0f, 0xa8, 0xa5, 0x51, 0x02},
+	{0x17, 0xc1, 0x24, 0x07, 0xf8, 0xf8, 0x22, 0x12},
+	{0x71, 0x23, 0x11, 0x06, 0x65, 0x74, 0x18, 0x16},
+	{0x01, 0x02, 0xd3, 0x05, 0xc9, 0x95, 0x03, 0x02},
+	{0x61, 0x63, 0x0c, 0x00, 0x94, 0xc0, 0x33, 0xf6},
+	{0x21, 0x72, 0x0d, 0x00, 0xc1, 0xd5, 0x56, 0x06},
+}
+
+// frequency multipliers, doubled
+var vrc7Multipliers = [16]uint32{1, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 20, 24, 24, 30, 30}
+
+// key scale level at block 7, in env units, by the top 4 bits of fnum
+var vrc7KSLTable = [16]int{0, 48, 64, 74, 80, 86, 90, 94, 96, 100, 102, 104, 106, 108, 110, 112}
+
+// vibrato, in 1/2 steps of fnum>>6
+var vrc7PMTable = [8]int{0, 1, 2, 1, 0, -1, -2, -1}
+
+// which of every 8 envelope updates actually step, by rate&3
+var vrc7EnvPatterns = [4][8]int{
+	{0, 1, 0, 1, 0, 1, 0, 1},
+	{0, 1, 0, 1, 1, 1, 0, 1},
+	{0, 1, 1, 1, 0, 1, 1, 1},
+	{0, 1, 1, 1, 1, 1, 1, 1},
+}
+
+// attenuation (log2 * 256) of the first quarter of a sine. This
+// formula gives exactly what the chip's rom holds (it's the OPL2's,
+// as read off the die by Gambrell and Niemitalo).
+var vrc7LogSinTable = makeVRC7LogSinTable()
+
+// to get back out of the log domain: the chip's exp rom, which is
+// round(1024 * (2^(i/256) - 1)), read backwards and with its
+// implied 1024 added back in, so it runs 2042 down to 1024
+var vrc7ExpTable = makeVRC7ExpTable()
+
+func makeVRC7LogSinTable() [256]int {
+	var table [256]int
+	for i := range table {
+		s := math.Sin((float64(i) + 0.5) * math.Pi / 512)
+		table[i] = int(math.Round(-math.Log2(s) * 256))
+	}
+	return table
+}
+
+func makeVRC7ExpTable() [256]int {
+	var table [256]int
+	for i := range table {
+		table[i] = 1024 + int(math.Round(1024*(math.Pow(2, float64(255-i)/256)-1)))
+	}
+	return table
+}
+
+// a full swing carrier has twice the peak to peak of a full apu pulse
+const vrc7LevelScale = apuPulseStep * 15 / 2048
+
+func (v *vrc7Audio) channelNames() []string {
+	return []string{
+		"VRC7 FM 1", "VRC7 FM 2", "VRC7 FM 3",
+		"VRC7 FM 4", "VRC7 FM 5", "VRC7 FM 6",
+	}
+}
+
+func (v *vrc7Audio) writeAddr(val byte) {
+	v.Addr = val
+}
+
+func (v *vrc7Audio) writeData(val byte) {
+	switch {
+	case v.Addr < 0x08:
+		v.CustomPatch[v.Addr] = val
+	case v.Addr >= 0x10 && v.Addr < 0x16:
+		ch := &v.Channels[v.Addr-0x10]
+		ch.Fnum = ch.Fnum&0x100 | uint16(val)
+	case v.Addr >= 0x20 && v.Addr < 0x26:
+		ch := &v.Channels[v.Addr-0x20]
+		ch.Fnum = ch.Fnum&0xff | uint16(val&0x01)<<8
+		ch.Block = (val >> 1) & 0x07
+		ch.Sustain = val&0x20 == 0x20
+		keyOn := val&0x10 == 0x10
+		if keyOn && !ch.KeyOn {
+			ch.Mod.EnvState = vrc7EnvDamp
+			ch.Car.EnvState = vrc7EnvDamp
+		} else if !keyOn && ch.KeyOn {
+			// the modulator carries on as it was
+			ch.Car.EnvState = vrc7EnvRelease
+		}
+		ch.KeyOn = keyOn
+	case v.Addr >= 0x30 && v.Addr < 0x36:
+		ch := &v.Channels[v.Addr-0x30]
+		ch.Instrument = val >> 4
+		ch.Volume = val & 0x0f
+	}
+}
+
+func (v *vrc7Audio) getPatch(ch *vrc7Channel) *[8]byte {
+	if ch.Instrument == 0 {
+		return &v.CustomPatch
+	}
+	return &vrc7Patches[ch.Instrument]
+}
+
+func (v *vrc7Audio) runCycle() {
+	v.CycleCount++
+	if v.CycleCount < vrc7CPUCyclesPerSample {
+		return
+	}
+	v.CycleCount = 0
+	v.SampleCount++
+
+	// tremolo is a 13 step (4.875dB) triangle at ~3.7hz
+	amIndex := int((v.SampleCount >> 6) % 210)
+	if amIndex >= 105 {
+		amIndex = 209 - amIndex
+	}
+	am := amIndex / 8
+	// vibrato is ~6.1hz
+	pm := vrc7PMTable[(v.SampleCount>>10)&0x07]
+
+	for i := range v.Channels {
+		v.runChannel(&v.Channels[i], am, pm)
+	}
+}
+
+func (v *vrc7Audio) runChannel(ch *vrc7Channel, am, pm int) {
+	patch := v.getPatch(ch)
+
+	// modulator
+	modBase := int(patch[2]&0x3f) << 1
+	modOut := v.runSlot(ch, &ch.Mod, patch, 0, modBase, am, pm)
+	feedback := int(patch[3] & 0x07)
+	var modPhaseOffset int
+	if feedback > 0 {
+		modPhaseOffset = (ch.Mod.Outputs[0] + ch.Mod.Outputs[1]) >> (9 - feedback)
+	}
+	ch.Mod.Outputs[1] = ch.Mod.Outputs[0]
+	ch.Mod.Outputs[0] = v.getSlotOutput(&ch.Mod, patch[3]&0x08 == 0x08, modOut, modPhaseOffset)
+
+	// carrier, phase modulated by the modulator
+	carBase := int(ch.Volume) << 3
+	carOut := v.runSlot(ch, &ch.Car, patch, 1, carBase, am, pm)
+	ch.Output = v.getSlotOutput(&ch.Car, patch[3]&0x10 == 0x10, carOut, ch.Mod.Outputs[0])
+}
+
+// runSlot steps an operator's phase and envelope, returning its total attenuation
+func (v *vrc7Audio) runSlot(ch *vrc7Channel, s *vrc7Slot, patch *[8]byte, n int, baseAtten, am, pm int) int {
+	flags := patch[n]
+	usesAM := flags&0x80 == 0x80
+	usesPM := flags&0x40 == 0x40
+	isSustainedTone := flags&0x20 == 0x20
+	usesKSR := flags&0x10 == 0x10
+	mult := vrc7Multipliers[flags&0x0f]
+
+	// phase
+	fnum2 := int(ch.Fnum) << 1
+	if usesPM {
+		fnum2 += pm * int(ch.Fnum>>6)
+	}
+	s.Phase = (s.Phase + (uint32(fnum2)<<ch.Block)*mult>>2) & 0x7ffff
+
+	// envelope
+	ksrVal := int(ch.Block)<<1 | int(ch.Fnum>>8)
+	if !usesKSR {
+		ksrVal >>= 2
+	}
+	attackRate := int(patch[4+n] >> 4)
+	decayRate := int(patch[4+n] & 0x0f)
+	sustainLevel := int(patch[6+n]>>4) << 3
+	releaseRate := int(patch[6+n] & 0x0f)
+
+	getRate := func(r int) int {
+		if r == 0 {
+			return 0
+		}
+		return minInt(r*4+ksrVal, 63)
+	}
+
+	switch s.EnvState {
+	case vrc7EnvDamp:
+		s.Env += v.getEnvIncrement(getRate(12))
+		if s.Env >= vrc7EnvMax-3 {
+			s.Phase = 0
+			s.EnvState = vrc7EnvAttack
+		}
+	case vrc7EnvAttack:
+		if attackRate == 15 {
+			s.Env = 0
+		} else if inc := v.getEnvIncrement(getRate(attackRate)); inc > 0 {
+			s.Env -= maxInt((s.Env*inc)>>3, 1)
+		}
+		if s.Env <= 0 {
+			s.Env = 0
+			s.EnvState = vrc7EnvDecay
+		}
+	case vrc7EnvDecay:
+		s.Env += v.getEnvIncrement(getRate(decayRate))
+		if s.Env >= sustainLevel {
+			s.EnvState = vrc7EnvSustain
+		}
+	case vrc7EnvSustain:
+		if !isSustainedTone {
+			// percussive tones just keep on decaying
+			s.Env += v.getEnvIncrement(getRate(releaseRate))
+		}
+	case vrc7EnvRelease:
+		rate := releaseRate
+		if ch.Sustain {
+			rate = 5
+		} else if !isSustainedTone {
+			rate = 7
+		}
+		s.Env += v.getEnvIncrement(getRate(rate))
+	}
+	s.Env = minInt(s.Env, vrc7EnvMax)
+
+	// total attenuation
+	ksl := int(patch[2+n] >> 6)
+	atten := s.Env + baseAtten
+	if ksl > 0 {
+		kslAtten := vrc7KSLTable[ch.Fnum>>5] - 16*(7-int(ch.Block))
+		if kslAtten > 0 {
+			atten += kslAtten >> (3 - ksl)
+		}
+	}
+	if usesAM {
+		atten += am
+	}
+	return minInt(atten, vrc7EnvMax)
+}
+
+// getEnvIncrement is how far an envelope at rate moves this sample
+func (v *vrc7Audio) getEnvIncrement(rate int) int {
+	if rate == 0 {
+		return 0
+	}
+	rateHi, rateLo := rate>>2, rate&0x03
+	if rateHi < 13 {
+		shift := uint(13 - rateHi)
+		if v.SampleCount&(1<<shift-1) != 0 {
+			return 0
+		}
+		return vrc7EnvPatterns[rateLo][(v.SampleCount>>shift)&0x07]
+	}
+	return vrc7EnvPatterns[rateLo][v.SampleCount&0x07] << uint(rateHi-13)
+}
+
+// getSlotOutput looks up the operator's wave at its phase (plus
+// any modulation), attenuated. Half-wave slots output nothing
+// for the negative half.
+func (v *vrc7Audio) getSlotOutput(s *vrc7Slot, isHalfWave bool, atten int, phaseOffset int) int {
+	idx := (int(s.Phase>>9) + phaseOffset) & 0x3ff
+	isNegative := idx >= 0x200
+	if isNegative && isHalfWave {
+		return 0
+	}
+	quarterIdx := idx & 0xff
+	if idx&0x100 != 0 {
+		quarterIdx = 0xff - quarterIdx
+	}
+	logAtten := vrc7LogSinTable[quarterIdx] + atten<<4
+	shift := logAtten >> 8
+	if shift >= 12 {
+		return 0
+	}
+	out := vrc7ExpTable[logAtten&0xff] >> uint(shift)
+	if isNegative {
+		return -out
+	}
+	return out
+}
+
+func (v *vrc7Audio) getOutputs(outputs []float64) {
+	for i := range v.Channels {
+		if v.Silenced {
+			outputs[i] = 0
+		} else {
+			outputs[i] = float64(v.Channels[i].Output) * vrc7LevelScale
+		}
+	}
+}
+
+func (v *vrc7Audio) getNotes(notes []channelNote) {
+	for i := range v.Channels {
+		ch := &v.Channels[i]
+		if v.Silenced || ch.Fnum == 0 || ch.Car.Env >= vrc7EnvMax {
+			notes[i] = channelNote{}
+			continue
+		}
+		// the phase is 19 bits, stepped by fnum<<block per sample
+		period := vrc7CPUCyclesPerSample * float64(1<<19) / float64(uint32(ch.Fnum)<<ch.Block)
+		volume := float64(15-ch.Volume) / 15 * float64(vrc7EnvMax-ch.Car.Env) / vrc7EnvMax
+		notes[i] = channelNote{Period: period, Volume: volume}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,114 @@
+package famigo
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// These check the vrc7 against what's documented about the
+// YM2413 (which the vrc7 is a cut down version of), rather than
+// against earlier renders of itself.
+
+// vrc7 regs are written through $9010 and $9030
+func asmVRC7Write(reg, val byte) []byte {
+	return asm(asmStore(0x9010, reg), asmStore(0x9030, val))
+}
+
+// a custom patch that's a plain sine: the carrier's a sustained
+// tone at x1 with an instant attack and no decay, and the
+// modulator has no attack, so it stays silent
+var vrc7SinePatch = [8]byte{0x01, 0x21, 0x3f, 0x00, 0x00, 0xf0, 0x00, 0x00}
+
+func TestVRC7Tables(t *testing.T) {
+	// first and last entries of the chip's log-sin and exp roms
+	if got := vrc7LogSinTable[0]; got != 0x859 {
+		t.Errorf("log-sin[0] is %#x, the rom has 0x859", got)
+	}
+	if got := vrc7LogSinTable[255]; got != 0 {
+		t.Errorf("log-sin[255] is %#x, the rom has 0", got)
+	}
+	if got := vrc7ExpTable[0]; got != 0x400+0x3fa {
+		t.Errorf("exp[0] is %#x, the rom has 0x3fa (+0x400)", got)
+	}
+	if got := vrc7ExpTable[255]; got != 0x400 {
+		t.Errorf("exp[255] is %#x, the rom has 0 (+0x400)", got)
+	}
+}
+
+// Per the YM2413 datasheet, a note plays at
+// fnum * 2^block * (3579545/72) / 2^19 hz.
+func TestVRC7RenderPitch(t *testing.T) {
+	const sampleRate = 44100
+	const fnum, block = 0x1ac, 4
+	want := fnum * (1 << block) * (3579545.0 / 72) / (1 << 19)
+
+	var init [][]byte
+	for i, val := range vrc7SinePatch {
+		init = append(init, asmVRC7Write(byte(i), val))
+	}
+	init = append(init,
+		asmVRC7Write(0x10, fnum&0xff),
+		asmVRC7Write(0x30, 0x00), // custom patch, full volume
+		asmVRC7Write(0x20, 0x10|block<<1|fnum>>8),
+		asmRTS,
+	)
+	nsf := makeTestNsf(nsfChipVRC7, asm(init...), asmRTS)
+	pcm := renderTestTrack(t, nsf, 500*time.Millisecond, 0, Options{
+		SampleRate:    sampleRate,
+		AudioChannels: 1,
+	})
+
+	// time from the first rising zero crossing to the last, with the
+	// first 0.1s skipped so the attack and dc blocker have settled
+	var first, last float64
+	crossings := 0
+	prev := 0.0
+	for i := sampleRate / 10; i+2 <= len(pcm)/2; i++ {
+		s := float64(int16(binary.LittleEndian.Uint16(pcm[i*2:])))
+		if i > sampleRate/10 && prev < 0 && s >= 0 {
+			at := float64(i-1) + -prev/(s-prev)
+			if crossings == 0 {
+				first = at
+			}
+			last = at
+			crossings++
+		}
+		prev = s
+	}
+	if crossings < 2 {
+		t.Fatalf("render has no pitch to measure")
+	}
+	got := float64(crossings-1) / ((last - first) / sampleRate)
+	if math.Abs(got-want)/want > 0.002 {
+		t.Fatalf("note came out at %.2fhz, want %.2fhz", got, want)
+	}
+}
+
+// Per the YM2413 datasheet, each step of a channel's volume is 3dB.
+func TestVRC7VolumeSteps(t *testing.T) {
+	peak := func(volume byte) int {
+		v := vrc7Audio{CustomPatch: vrc7SinePatch}
+		for _, w := range [][2]byte{{0x10, 0xac}, {0x30, volume}, {0x20, 0x19}} {
+			v.writeAddr(w[0])
+			v.writeData(w[1])
+		}
+		max := 0
+		for i := 0; i < 200000; i++ {
+			v.runCycle()
+			if i > 100000 && v.Channels[0].Output > max {
+				max = v.Channels[0].Output
+			}
+		}
+		return max
+	}
+	full := float64(peak(0))
+	for volume := byte(1); volume < 5; volume++ {
+		want := math.Pow(10, -3*float64(volume)/20)
+		got := float64(peak(volume)) / full
+		if math.Abs(got-want)/want > 0.01 {
+			t.Errorf("volume %v is %.3f of full, want %.3f (-%vdB)", volume, got, want, 3*volume)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package famigo
+
+// vrcIRQ is the irq counter shared by the VRC4, VRC6, and VRC7.
+// In scanline mode, a prescaler turns cpu cycles into (roughly)
+// scanlines, so it doesn't need to watch the ppu at all.
+type vrcIRQ struct {
+	Latch     byte
+	Counter   byte
+	Prescaler int
+
+	EnabledAfterAck bool
+	Enabled         bool
+	CycleMode       bool
+	Requested       bool
+}
+
+func (v *vrcIRQ) writeLatch(val byte) {
+	v.Latch = val
+}
+
+func (v *vrcIRQ) writeControl(val byte) {
+	v.EnabledAfterAck = val&0x01 == 0x01
+	v.Enabled = val&0x02 == 0x02
+	v.CycleMode = val&0x04 == 0x04
+	v.Requested = false
+	v.Prescaler = 341
+	if v.Enabled {
+		v.Counter = v.Latch
+	}
+}
+
+func (v *vrcIRQ) writeAck() {
+	v.Requested = false
+	v.Enabled = v.EnabledAfterAck
+}
+
+func (v *vrcIRQ) runCycle(emu *emuState) {
+	if v.Enabled {
+		if v.CycleMode {
+			v.clockCounter()
+		} else {
+			// 341 ppu dots per line, 3 per cpu cycle
+			v.Prescaler -= 3
+			if v.Prescaler <= 0 {
+				v.Prescaler += 341
+				v.clockCounter()
+			}
+		}
+	}
+	if v.Requested {
+		emu.CPU.IRQ = true // level triggered, held until ack'd
+	}
+}
+
+func (v *vrcIRQ) clockCounter() {
+	if v.Counter == 0xff {
+		v.Counter = v.Latch
+		v.Requested = true
+	} else {
+		v.Counter++
+	}
+}
@@ -0,0 +1,64 @@
+package famigo
+
+// Zapper is the state of a light gun
+type Zapper struct {
+	// X and Y are the screen coords being aimed at.
+	// Anything outside of 256x240 is off screen.
+	X, Y    int
+	Trigger bool
+}
+
+const (
+	// how long the zapper's light sensor stays lit after the
+	// beam passes the aim point (it's ~20-25 lines on hw)
+	zapperSenseLines = 20
+	// radius around the aim point the sensor can see
+	zapperSenseRadius = 2
+	// 0-255 luma needed to count as light
+	zapperLightThreshold = 0x80
+)
+
+func (emu *emuState) readZapper() byte {
+	z := &emu.CurrentZapper
+	return 0x40 | boolBit(z.Trigger, 4) | boolBit(!emu.zapperSensesLight(), 3)
+}
+
+func (emu *emuState) zapperSensesLight() bool {
+	z := &emu.CurrentZapper
+	ppu := &emu.PPU
+	if z.X < 0 || z.X >= 256 || z.Y < 0 || z.Y >= 240 {
+		return false
+	}
+	if ppu.LineY < 0 || ppu.LineY >= 240 {
+		return false // nothing being drawn
+	}
+
+	// only consider pixels drawn this frame, and only
+	// while the sensor would still be lit by them
+	if ppu.LineY < z.Y-zapperSenseRadius || ppu.LineY > z.Y+zapperSenseRadius+zapperSenseLines {
+		return false
+	}
+	for y := z.Y - zapperSenseRadius; y <= z.Y+zapperSenseRadius; y++ {
+		if y < 0 || y >= 240 || y > ppu.LineY {
+			continue
+		}
+		for x := z.X - zapperSenseRadius; x <= z.X+zapperSenseRadius; x++ {
+			if x < 0 || x >= 256 {
+				continue
+			}
+			if y == ppu.LineY && x >= ppu.LineX {
+				break // not drawn yet
+			}
+			if ppu.getFrameBufferLuma(x, y) >= zapperLightThreshold {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ppu *ppu) getFrameBufferLuma(x, y int) int {
+	i := (y*256 + x) * 4
+	r, g, b := int(ppu.FrameBuffer[i]), int(ppu.FrameBuffer[i+1]), int(ppu.FrameBuffer[i+2])
+	return (299*r + 587*g + 114*b) / 1000
+}